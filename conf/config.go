@@ -25,12 +25,43 @@ type Config struct {
 		WriteBufferSize    int  `yaml:"WriteBufferSize"`
 		MaxRequestBodySize int  `yaml:"MaxRequestBodySize"`
 		ReduceMemoryUsage  bool `yaml:"ReduceMemoryUsage"`
+
+		TLS struct {
+			ListenPort     int    `yaml:"ListenPort"`
+			MinVersion     string `yaml:"MinVersion"`
+			ReloadInterval int    `yaml:"ReloadInterval"`
+
+			Certificates []struct {
+				CertFile string `yaml:"CertFile"`
+				KeyFile  string `yaml:"KeyFile"`
+			} `yaml:"Certificates"`
+		} `yaml:"TLS"`
 	} `yaml:"Server"`
 
 	Client struct {
 		Name                string `yaml:"Name"`
 		MaxConnsPerHost     int    `yaml:"MaxConnsPerHost"`
 		MaxIdleConnDuration int    `yaml:"MaxIdleConnDuration"`
+
+		Retry struct {
+			MaxAttempts         int     `yaml:"MaxAttempts"`
+			RetryOn             []int   `yaml:"RetryOn"`
+			BudgetRatio         float64 `yaml:"BudgetRatio"`
+			MinRetriesPerSecond int     `yaml:"MinRetriesPerSecond"`
+		} `yaml:"Retry"`
+
+		Mirror struct {
+			MaxInflight int `yaml:"MaxInflight"`
+		} `yaml:"Mirror"`
+
+		Outlier struct {
+			ConsecutiveFailures int     `yaml:"ConsecutiveFailures"`
+			FailureRate         float64 `yaml:"FailureRate"`
+			MinRequests         int     `yaml:"MinRequests"`
+			Interval            int     `yaml:"Interval"`
+			BaseEjectionTime    int     `yaml:"BaseEjectionTime"`
+			MaxEjectionTime     int     `yaml:"MaxEjectionTime"`
+		} `yaml:"Outlier"`
 	} `yaml:"client"`
 
 	Etcd struct {
@@ -0,0 +1,201 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/hhjpin/goutils/logger"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// KeyPair is the location of a pem certificate chain and its private key
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Store holds the certificates of the https listener and picks them by the SNI of the client. The files are polled
+// and reloaded when one of them changed, the new certificates are swapped in atomically: handshakes in progress keep
+// the certificates they started with and the established connections are not affected. A reload failing (e.g. the
+// certificate was written but not the key yet) keeps the previous certificates and is retried on the next change.
+type Store struct {
+	pairs []KeyPair
+
+	mu     sync.Mutex
+	stamps []fileStamp
+	// *certTable
+	current atomic.Value
+}
+
+// fileStamp identifies the content of a file without reading it
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// certTable is the read-only lookup of the certificates, keyed by lower case dns name (`*.example.com` for
+// wildcards). The first pair is the fallback of the clients without SNI or asking an unknown name.
+type certTable struct {
+	names    map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// NewStore loads the key pairs, the certificates are taken in order so the first pair is the default one
+func NewStore(pairs []KeyPair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.NewFormat(200, "tls listener lack of certificates")
+	}
+	s := &Store{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseMinVersion converts the `Server.TLS.MinVersion` option, an empty value means tls 1.2
+func ParseMinVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.NewFormat(200, fmt.Sprintf("unsupported tls version: %s", version))
+}
+
+// Config returns the server config of the https listener
+func (s *Store) Config(minVersion uint16) *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     minVersion,
+	}
+}
+
+// GetCertificate picks the certificate of the server name sent by the client, exact names are preferred to
+// wildcards
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t := s.current.Load().(*certTable)
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := t.names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := t.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return t.fallback, nil
+}
+
+// Reload reads all the key pairs again and replaces the certificates if every pair is valid
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reload()
+}
+
+// Refresh reloads the key pairs if one of the files changed since the last load, true is returned when the
+// certificates were replaced
+func (s *Store) Refresh() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamps := s.stat()
+	if len(stamps) == len(s.stamps) {
+		changed := false
+		for i := range stamps {
+			if !stamps[i].modTime.Equal(s.stamps[i].modTime) || stamps[i].size != s.stamps[i].size {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return false, nil
+		}
+	}
+	if err := s.reload(); err != nil {
+		// not retried until the files change again
+		s.stamps = stamps
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch checks the files every interval and reloads them when they changed, it never returns
+func (s *Store) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := s.Refresh()
+		if err != nil {
+			logger.Errorf("reload tls certificates failed, previous certificates kept: %s", err)
+		} else if reloaded {
+			logger.Infof("tls certificates reloaded")
+		}
+	}
+}
+
+// reload loads the key pairs, the stamps are taken first so a file written during the load is loaded again on the
+// next refresh
+func (s *Store) reload() error {
+	stamps := s.stat()
+	t := &certTable{names: make(map[string]*tls.Certificate)}
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return errors.NewFormat(200, fmt.Sprintf("load tls certificate %s failed: %s", pair.CertFile, err))
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.NewFormat(200, fmt.Sprintf("parse tls certificate %s failed: %s", pair.CertFile, err))
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// the first pair serving a name wins
+			if _, ok := t.names[name]; !ok {
+				t.names[name] = &cert
+			}
+		}
+		if t.fallback == nil {
+			t.fallback = &cert
+		}
+	}
+	s.stamps = stamps
+	s.current.Store(t)
+	return nil
+}
+
+// stat returns the stamps of the files of all pairs, missing files get a zero stamp
+func (s *Store) stat() []fileStamp {
+	stamps := make([]fileStamp, 0, len(s.pairs)*2)
+	for _, pair := range s.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			var stamp fileStamp
+			if info, err := os.Stat(file); err == nil {
+				stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			}
+			stamps = append(stamps, stamp)
+		}
+	}
+	return stamps
+}
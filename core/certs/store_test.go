@@ -0,0 +1,117 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate of the names to dir, the serial number tells the versions apart
+func writeKeyPair(t *testing.T, dir, file string, serial int64, names ...string) KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := KeyPair{CertFile: filepath.Join(dir, file+".crt"), KeyFile: filepath.Join(dir, file+".key")}
+	if err = ioutil.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func serialOf(t *testing.T, s *Store, name string) int64 {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil || cert == nil {
+		t.Fatalf("%s: no certificate, err: %v", name, err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := writeKeyPair(t, dir, "a", 1, "a.example.com")
+	second := writeKeyPair(t, dir, "b", 2, "b.example.com", "*.b.example.com")
+	s, err := NewStore([]KeyPair{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, serial := range map[string]int64{
+		"a.example.com":     1,
+		"B.Example.com.":    2,
+		"api.b.example.com": 2,
+		"c.example.com":     1,
+		"":                  1,
+	} {
+		if got := serialOf(t, s, name); got != serial {
+			t.Fatalf("%s: unexpected certificate %d, expected %d", name, got, serial)
+		}
+	}
+
+	if reloaded, err := s.Refresh(); reloaded || err != nil {
+		t.Fatalf("unchanged files reloaded: %v, err: %v", reloaded, err)
+	}
+	writeKeyPair(t, dir, "b", 3, "b.example.com")
+	// the modification time may not change within the resolution of the file system
+	past := time.Now().Add(-time.Minute)
+	_ = os.Chtimes(second.CertFile, past, past)
+	if reloaded, err := s.Refresh(); !reloaded || err != nil {
+		t.Fatalf("changed files not reloaded: %v, err: %v", reloaded, err)
+	}
+	if got := serialOf(t, s, "b.example.com"); got != 3 {
+		t.Fatalf("unexpected certificate after reload: %d", got)
+	}
+	if got := serialOf(t, s, "api.b.example.com"); got != 1 {
+		t.Fatalf("dropped wildcard still served: %d", got)
+	}
+
+	// a broken pair keeps the previous certificates
+	if err = ioutil.WriteFile(second.KeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := s.Refresh(); reloaded || err == nil {
+		t.Fatalf("broken pair loaded: %v, err: %v", reloaded, err)
+	}
+	if got := serialOf(t, s, "b.example.com"); got != 3 {
+		t.Fatalf("certificates not kept after failed reload: %d", got)
+	}
+
+	if _, err = ParseMinVersion("1.4"); err == nil {
+		t.Fatal("expected error for unsupported tls version")
+	}
+	if v, _ := ParseMinVersion(""); v != tls.VersionTLS12 {
+		t.Fatalf("unexpected default tls version: %x", v)
+	}
+}
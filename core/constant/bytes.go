@@ -22,6 +22,8 @@ var (
 	RouterDefinitionBytes  = []byte("/Router/")
 	ServiceDefinitionBytes = []byte("/Service/")
 
+	WeightKeyBytes = []byte("Weight")
+
 	//StrSlash            = []byte("/")
 	//StrSlashSlash       = []byte("//")
 	//StrSlashDotDot      = []byte("/..")
@@ -12,6 +12,7 @@ const (
 	HealthCheckDefinition       = "/HealthCheck/"
 	HealthCheckPrefixDefinition = "/HealthCheck/HC-"
 	HealthCheckPrefixString     = "HC-%s/"
+	DrainPrefixDefinition       = "/Drain/Node-"
 
 	IdKeyString          = "ID"
 	NameKeyString        = "Name"
@@ -29,4 +30,29 @@ const (
 	RetryTimeKeyString   = "RetryTime"
 	NodeKeyString        = "Node"
 	FailedTimesKeyString = "FailedTimes"
+	MatchKeyString       = "Match"
+
+	AcceptHttpMethodKeyString   = "AcceptHttpMethod"
+	MaxAttemptsKeyString        = "MaxAttempts"
+	RetryNonIdempotentKeyString = "RetryNonIdempotent"
+	WeightKeyString             = "Weight"
+	LoadBalancerKeyString       = "LoadBalancer"
+	HashKeyKeyString            = "HashKey"
+	SplitKeyString              = "Split"
+	MirrorKeyString             = "Mirror"
+	TypeKeyString               = "Type"
+	MethodKeyString             = "Method"
+	HeadersKeyString            = "Headers"
+	ExpectStatusKeyString       = "ExpectStatus"
+	BodyContainsKeyString       = "BodyContains"
+	BodyRegexKeyString          = "BodyRegex"
+	SlowStartKeyString          = "SlowStart"
+
+	MaxConnsKeyString            = "MaxConns"
+	MaxIdleConnDurationKeyString = "MaxIdleConnDuration"
+	KeepAliveKeyString           = "KeepAlive"
+	StreamingKeyString           = "Streaming"
+	WebSocketKeyString           = "WebSocket"
+	SchemeKeyString              = "Scheme"
+	TLSKeyString                 = "TLS"
 )
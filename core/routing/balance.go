@@ -0,0 +1,333 @@
+package routing
+
+import (
+	"fmt"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// weight of endpoints without the `Weight` attribute
+	defaultEndpointWeight = 1
+
+	// values of the `LoadBalancer` attribute of services
+	roundRobinBalancer     = "round_robin"
+	leastRequestBalancer   = "least_request"
+	powerOfTwoBalancer     = "p2c"
+	consistentHashBalancer = "consistent_hash"
+
+	// prefixes of the `HashKey` attribute of services, `ip` hashes the client ip
+	hashKeyIP     = "ip"
+	hashKeyHeader = "header:"
+	hashKeyCookie = "cookie:"
+
+	// virtual nodes per weight unit on the consistent hash ring, the weights are divided by their gcd first and the
+	// ring is scaled down to maxHashRingNodes, a large weight does not blow up the snapshot rebuilds
+	hashReplicas     = 64
+	maxHashRingNodes = 1 << 14
+)
+
+// balancer picks an endpoint of a service for a request. Endpoints rejected by `exclude` are skipped, e.g. the
+// ones already tried by a retry, nil is returned when no endpoint is left. Balancers are built with the snapshot
+// and must be safe for concurrent use.
+type balancer interface {
+	pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry
+}
+
+// parseWeight parses the `Weight` attribute of endpoints
+func parseWeight(value []byte) (int, error) {
+	weight, err := strconv.ParseUint(string(value), 10, 16)
+	if err != nil {
+		return 0, errors.NewFormat(200, fmt.Sprintf("invalid endpoint weight: %s", string(value)))
+	}
+	return int(weight), nil
+}
+
+// parseLoadBalancer parses the `LoadBalancer` attribute of services
+func parseLoadBalancer(value []byte) (string, error) {
+	lb := strings.ToLower(strings.TrimSpace(string(value)))
+	switch lb {
+	case roundRobinBalancer, leastRequestBalancer, powerOfTwoBalancer, consistentHashBalancer:
+		return lb, nil
+	}
+	return "", errors.NewFormat(200, fmt.Sprintf("unsupported load balancer: %s", string(value)))
+}
+
+// parseHashKey parses the `HashKey` attribute of services: `ip`, `header:<name>` or `cookie:<name>`
+func parseHashKey(value []byte) (string, error) {
+	key := strings.TrimSpace(string(value))
+	if strings.ToLower(key) == hashKeyIP {
+		return hashKeyIP, nil
+	}
+	for _, prefix := range []string{hashKeyHeader, hashKeyCookie} {
+		if strings.HasPrefix(strings.ToLower(key), prefix) && len(key) > len(prefix) {
+			return prefix + key[len(prefix):], nil
+		}
+	}
+	return "", errors.NewFormat(200, fmt.Sprintf("invalid hash key: %s", string(value)))
+}
+
+func newBalancer(s *Service, entry *serviceEntry) balancer {
+	switch s.loadBalancer {
+	case leastRequestBalancer:
+		return &leastRequest{svr: entry}
+	case powerOfTwoBalancer:
+		return &powerOfTwo{svr: entry}
+	case consistentHashBalancer:
+		if s.hashKey == "" {
+			return newHashRing(entry, hashKeyIP)
+		}
+		return newHashRing(entry, s.hashKey)
+	default:
+		return &roundRobin{svr: entry}
+	}
+}
+
+// pick chooses an endpoint of the service with its balancer, endpoints ejected by the outlier detector are skipped.
+// When every endpoint is ejected the ejection is ignored, sending traffic to failing endpoints is better than
+// failing every request.
+func (s *serviceEntry) pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry {
+	b := s.balancer
+	if b == nil {
+		b = &roundRobin{svr: s}
+	}
+	now := time.Now().UnixNano()
+	var taken []*endpointEntry
+	for i := 0; i <= len(s.endpoints); i++ {
+		ep := b.pick(ctx, func(ep *endpointEntry) bool {
+			if exclude != nil && exclude(ep) || !ep.stats.available(now) {
+				return true
+			}
+			for _, t := range taken {
+				if t == ep {
+					return true
+				}
+			}
+			return false
+		})
+		if ep == nil {
+			break
+		}
+		if ep.stats.claim(now) {
+			return ep
+		}
+		// the probe of the half-open endpoint was taken by another request
+		taken = append(taken, ep)
+	}
+	return b.pick(ctx, exclude)
+}
+
+// next picks the next endpoint. Endpoints sharing the same weight are picked in plain round-robin order without
+// locking, otherwise the smooth weighted round-robin of nginx is used: every endpoint gains its weight on each
+// pick, the one with the highest current weight is picked and loses the total weight. It spreads the picks of
+// heavy endpoints evenly instead of sending them in bursts. Endpoints in slow start use their ramped weight.
+func (s *serviceEntry) next() *endpointEntry {
+	if len(s.endpoints) == 0 {
+		return nil
+	}
+	b := s.balance
+	now := time.Now().UnixNano()
+	if !s.weighted && !s.warming(now) {
+		idx := atomic.AddUint64(&b.cursor, 1) - 1
+		return s.endpoints[idx%uint64(len(s.endpoints))]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *endpointEntry
+	bestCurrent, total := 0, 0
+	for _, ep := range s.endpoints {
+		weight := ep.effectiveWeight(now)
+		current := b.current[ep.name] + weight
+		b.current[ep.name] = current
+		total += weight
+		if best == nil || current > bestCurrent {
+			best, bestCurrent = ep, current
+		}
+	}
+	b.current[best.name] -= total
+	return best
+}
+
+// roundRobin is the default balancer, weighted when the endpoints have different weights
+type roundRobin struct {
+	svr *serviceEntry
+}
+
+func (b *roundRobin) pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry {
+	for i := 0; i < len(b.svr.endpoints); i++ {
+		ep := b.svr.next()
+		if exclude == nil || !exclude(ep) {
+			return ep
+		}
+	}
+	return nil
+}
+
+// leastRequest picks the endpoint with the fewest outstanding requests relative to its weight, ties are broken
+// from a random start to avoid sending a burst to the same endpoint
+type leastRequest struct {
+	svr *serviceEntry
+}
+
+func (b *leastRequest) pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry {
+	endpoints := b.svr.endpoints
+	if len(endpoints) == 0 {
+		return nil
+	}
+	var best *endpointEntry
+	now := time.Now().UnixNano()
+	start := rand.Intn(len(endpoints))
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[(start+i)%len(endpoints)]
+		if exclude != nil && exclude(ep) {
+			continue
+		}
+		if best == nil || ep.lessLoaded(best, now) {
+			best = ep
+		}
+	}
+	return best
+}
+
+// powerOfTwo picks two random endpoints and keeps the less loaded one, it avoids the herd behaviour of
+// leastRequest when many gateways share the same stale view of the load
+type powerOfTwo struct {
+	svr *serviceEntry
+}
+
+func (b *powerOfTwo) pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry {
+	candidates := b.svr.endpoints
+	if exclude != nil {
+		candidates = make([]*endpointEntry, 0, len(b.svr.endpoints))
+		for _, ep := range b.svr.endpoints {
+			if !exclude(ep) {
+				candidates = append(candidates, ep)
+			}
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].lessLoaded(candidates[i], time.Now().UnixNano()) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// lessLoaded compares outstanding requests divided by the effective weight without division
+func (e *endpointEntry) lessLoaded(another *endpointEntry, now int64) bool {
+	return e.stats.outstanding()*int64(another.effectiveWeight(now)) <
+		another.stats.outstanding()*int64(e.effectiveWeight(now))
+}
+
+// hashRing maps a request key onto a ring of virtual endpoint nodes, adding or removing an endpoint only moves the
+// keys next to its own nodes. Requests without the key are balanced in round-robin order. The ring is built with the
+// full weights, slow start does not apply to keyed requests.
+type hashRing struct {
+	svr      *serviceEntry
+	key      string
+	hashes   []uint32
+	replicas []*endpointEntry
+}
+
+func newHashRing(entry *serviceEntry, key string) *hashRing {
+	ring := &hashRing{svr: entry, key: key}
+	type node struct {
+		hash uint32
+		ep   *endpointEntry
+	}
+	replicas := hashRingReplicas(entry.endpoints)
+	var nodes []node
+	for k, ep := range entry.endpoints {
+		for i := 0; i < replicas[k]; i++ {
+			nodes = append(nodes, node{hash: crc32.ChecksumIEEE([]byte(string(ep.name) + "#" + strconv.Itoa(i))), ep: ep})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].hash != nodes[j].hash {
+			return nodes[i].hash < nodes[j].hash
+		}
+		return nodes[i].ep.name < nodes[j].ep.name
+	})
+	for _, n := range nodes {
+		ring.hashes = append(ring.hashes, n.hash)
+		ring.replicas = append(ring.replicas, n.ep)
+	}
+	return ring
+}
+
+// hashRingReplicas returns the number of virtual nodes of each endpoint, every endpoint keeps at least one
+func hashRingReplicas(endpoints []*endpointEntry) []int {
+	divisor := 0
+	for _, ep := range endpoints {
+		divisor = gcd(divisor, ep.weight)
+	}
+	total := 0
+	replicas := make([]int, len(endpoints))
+	for i, ep := range endpoints {
+		replicas[i] = hashReplicas * ep.weight / divisor
+		total += replicas[i]
+	}
+	if total > maxHashRingNodes {
+		for i := range replicas {
+			if replicas[i] = replicas[i] * maxHashRingNodes / total; replicas[i] == 0 {
+				replicas[i] = 1
+			}
+		}
+	}
+	return replicas
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func (b *hashRing) pick(ctx *fasthttp.RequestCtx, exclude func(ep *endpointEntry) bool) *endpointEntry {
+	key := b.requestKey(ctx)
+	if len(key) == 0 || len(b.hashes) == 0 {
+		return (&roundRobin{svr: b.svr}).pick(ctx, exclude)
+	}
+	hash := crc32.ChecksumIEEE(key)
+	idx := sort.Search(len(b.hashes), func(i int) bool {
+		return b.hashes[i] >= hash
+	})
+	// walk clockwise to the first endpoint which is not excluded
+	for i := 0; i < len(b.replicas); i++ {
+		ep := b.replicas[(idx+i)%len(b.replicas)]
+		if exclude == nil || !exclude(ep) {
+			return ep
+		}
+	}
+	return nil
+}
+
+func (b *hashRing) requestKey(ctx *fasthttp.RequestCtx) []byte {
+	switch {
+	case b.key == hashKeyIP:
+		return []byte(ctx.RemoteIP().String())
+	case strings.HasPrefix(b.key, hashKeyHeader):
+		return ctx.Request.Header.Peek(b.key[len(hashKeyHeader):])
+	case strings.HasPrefix(b.key, hashKeyCookie):
+		return ctx.Request.Header.Cookie(b.key[len(hashKeyCookie):])
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package routing
+
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestService(weights map[string]int) *Service {
+	svr := &Service{name: []byte("svr"), ep: NewEndpointTableMap()}
+	for name, weight := range weights {
+		svr.ep.Store(EndpointNameString(name), &Endpoint{
+			name:       []byte(name),
+			nameString: EndpointNameString(name),
+			host:       []byte("127.0.0.1"),
+			status:     Online,
+			weight:     weight,
+		})
+	}
+	return svr
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	svr := newTestService(map[string]int{"a": 5, "b": 1, "c": 1, "d": 0})
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+	if len(entry.endpoints) != 3 || !entry.weighted {
+		t.Fatalf("unexpected endpoints: %d, weighted: %t", len(entry.endpoints), entry.weighted)
+	}
+
+	var picks []EndpointNameString
+	count := make(map[EndpointNameString]int)
+	for i := 0; i < 7; i++ {
+		ep := entry.next()
+		picks = append(picks, ep.name)
+		count[ep.name]++
+	}
+	if count["a"] != 5 || count["b"] != 1 || count["c"] != 1 || count["d"] != 0 {
+		t.Fatalf("unexpected distribution: %v", count)
+	}
+	// smooth: the heavy endpoint is not picked five times in a row
+	if picks[0] != "a" || picks[1] != "a" || picks[2] == "a" {
+		t.Fatalf("unexpected order: %v", picks)
+	}
+}
+
+func TestRoundRobinAcrossPublish(t *testing.T) {
+	r := newTestTable()
+	weighted := newTestService(map[string]int{"a": 5, "b": 1})
+	addTestRouter(t, r, "weighted", "GET@/weighted", weighted, nil)
+	even := newTestService(map[string]int{"c": 1, "d": 1, "e": 1})
+	even.name = []byte("even")
+	addTestRouter(t, r, "even", "GET@/even", even, nil)
+
+	// every pick is made on a new snapshot, the rotation goes on where the previous snapshot left it
+	pick := func(path string) EndpointNameString {
+		r.publish()
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(path)
+		target, err := r.Select(&ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target.release()
+		return target.endpoint().name
+	}
+	count := make(map[EndpointNameString]int)
+	for i := 0; i < 6; i++ {
+		count[pick("/weighted")]++
+	}
+	if count["a"] != 5 || count["b"] != 1 {
+		t.Fatalf("unexpected weighted distribution: %v", count)
+	}
+	for i := 0; i < 3; i++ {
+		count[pick("/even")]++
+	}
+	if count["c"] != 1 || count["d"] != 1 || count["e"] != 1 {
+		t.Fatalf("unexpected round-robin distribution: %v", count)
+	}
+
+	// the state of a removed service is dropped
+	r.serviceTable.Delete(even.nameString)
+	r.publish()
+	if len(r.balances.internal) != 1 {
+		t.Fatalf("unexpected balancer states: %d", len(r.balances.internal))
+	}
+}
+
+func TestLeastRequest(t *testing.T) {
+	svr := newTestService(map[string]int{"a": 1, "b": 1, "c": 2})
+	svr.loadBalancer = leastRequestBalancer
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+	load := map[EndpointNameString]int64{"a": 3, "b": 1, "c": 3}
+	for _, ep := range entry.endpoints {
+		ep.stats.inflight = load[ep.name]
+	}
+	// c has 3 requests in flight but twice the weight of b
+	if ep := entry.pick(nil, nil); ep.name != "b" {
+		t.Fatalf("unexpected endpoint: %s", ep.name)
+	}
+	if ep := entry.pick(nil, func(ep *endpointEntry) bool { return ep.name == "b" }); ep.name != "c" {
+		t.Fatalf("unexpected endpoint: %s", ep.name)
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	svr := newTestService(map[string]int{"a": 1, "b": 1})
+	svr.loadBalancer = powerOfTwoBalancer
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+	for _, ep := range entry.endpoints {
+		if ep.name == "a" {
+			ep.stats.inflight = 10
+		}
+	}
+	// with two endpoints both are always compared
+	for i := 0; i < 10; i++ {
+		if ep := entry.pick(nil, nil); ep.name != "b" {
+			t.Fatalf("unexpected endpoint: %s", ep.name)
+		}
+	}
+	if ep := entry.pick(nil, func(ep *endpointEntry) bool { return ep.name == "b" }); ep.name != "a" {
+		t.Fatalf("unexpected endpoint: %s", ep.name)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	weights := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		weights["ep-"+strconv.Itoa(i)] = 1
+	}
+	svr := newTestService(weights)
+	svr.loadBalancer = consistentHashBalancer
+	svr.hashKey = hashKeyHeader + "X-User"
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+
+	pick := func(entry *serviceEntry, user string) EndpointNameString {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.Set("X-User", user)
+		return entry.pick(&ctx, nil).name
+	}
+	before := make(map[string]EndpointNameString)
+	for i := 0; i < 1000; i++ {
+		user := strconv.Itoa(i)
+		before[user] = pick(entry, user)
+		if pick(entry, user) != before[user] {
+			t.Fatalf("user %s is not sticky", user)
+		}
+	}
+
+	// removing an endpoint only moves the keys it owned
+	svr.ep.Delete("ep-0")
+	entry = newServiceEntry(svr, newEndpointStatsMap())
+	for user, ep := range before {
+		if ep != "ep-0" && pick(entry, user) != ep {
+			t.Fatalf("user %s moved from %s to %s", user, ep, pick(entry, user))
+		}
+	}
+}
+
+func TestHashRingReplicas(t *testing.T) {
+	replicas := hashRingReplicas([]*endpointEntry{{weight: 200}, {weight: 100}})
+	if replicas[0] != 2*hashReplicas || replicas[1] != hashReplicas {
+		t.Fatalf("weights not normalized: %v", replicas)
+	}
+	replicas = hashRingReplicas([]*endpointEntry{{weight: 65535}, {weight: 65534}, {weight: 1}})
+	if total := replicas[0] + replicas[1] + replicas[2]; total > maxHashRingNodes {
+		t.Fatalf("ring of %d nodes exceeds the cap", total)
+	}
+	if replicas[2] != 1 || replicas[0] < replicas[1] {
+		t.Fatalf("unexpected scaled replicas: %v", replicas)
+	}
+}
+
+func TestParseHashKey(t *testing.T) {
+	cases := map[string]string{
+		"ip":             hashKeyIP,
+		"IP":             hashKeyIP,
+		"header:X-User":  "header:X-User",
+		"Cookie:session": "cookie:session",
+	}
+	for value, expected := range cases {
+		if key, err := parseHashKey([]byte(value)); err != nil || key != expected {
+			t.Fatalf("%s: unexpected hash key %s, err: %v", value, key, err)
+		}
+	}
+	for _, value := range []string{"", "header:", "query:id"} {
+		if _, err := parseHashKey([]byte(value)); err == nil {
+			t.Fatalf("%s: expected error", value)
+		}
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	d := &outlierDetector{
+		consecutiveFailures: 3,
+		failureRate:         0.5,
+		minRequests:         10,
+		interval:            int64(time.Minute),
+		baseEjectionTime:    int64(time.Hour),
+		maxEjectionTime:     int64(3 * time.Hour),
+	}
+	entry := newServiceEntry(newTestService(map[string]int{"a": 1, "b": 1}), newEndpointStatsMap())
+	a, b := entry.endpoints[0], entry.endpoints[1]
+
+	now := time.Now().UnixNano()
+	d.record(a.stats, true, now, "a")
+	d.record(a.stats, true, now, "a")
+	d.record(a.stats, false, now, "a")
+	d.record(a.stats, true, now, "a")
+	if a.stats.ejected() {
+		t.Fatal("a success resets the consecutive failures")
+	}
+	d.record(a.stats, true, now, "a")
+	d.record(a.stats, true, now, "a")
+	if !a.stats.ejected() {
+		t.Fatal("expected ejection after consecutive failures")
+	}
+	for i := 0; i < 10; i++ {
+		if entry.pick(nil, nil) != b {
+			t.Fatal("picked an ejected endpoint")
+		}
+	}
+
+	// failure rate
+	for i := 0; i < 10; i++ {
+		d.record(b.stats, i%2 == 1, now, "b")
+	}
+	if !b.stats.ejected() {
+		t.Fatal("expected ejection on failure rate")
+	}
+	// every endpoint is ejected, traffic is not refused
+	if entry.pick(nil, nil) == nil {
+		t.Fatal("expected an endpoint when every endpoint is ejected")
+	}
+
+	// half-open: one probe only, its failure doubles the ejection time
+	later := a.stats.ejectedUntil
+	if !a.stats.available(later) || !a.stats.claim(later) || a.stats.available(later) || a.stats.claim(later) {
+		t.Fatal("expected a single probe")
+	}
+	d.record(a.stats, true, later, "a")
+	if a.stats.ejectedUntil != later+2*int64(time.Hour) || a.stats.probing != 0 {
+		t.Fatalf("unexpected ejection: %d", a.stats.ejectedUntil-later)
+	}
+	later = a.stats.ejectedUntil
+	a.stats.claim(later)
+	d.record(a.stats, false, later, "a")
+	if a.stats.ejected() || a.stats.ejections != 0 {
+		t.Fatal("expected the endpoint back after a successful probe")
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	svr := newTestService(map[string]int{"a": 1, "b": 1})
+	svr.slowStart = 10 * time.Second
+	stats := newEndpointStatsMap()
+	now := time.Now().UnixNano()
+	// a is online for a long time, b just came back
+	stats.LoadOrCreate("a").onlineSince = 1
+	stats.LoadOrCreate("b").onlineSince = now
+	entry := newServiceEntry(svr, stats)
+	if !entry.warming(now) || entry.warmUntil != now+int64(10*time.Second) {
+		t.Fatalf("unexpected warm until: %d", entry.warmUntil)
+	}
+
+	count := make(map[EndpointNameString]int)
+	for i := 0; i < 110; i++ {
+		count[entry.next().name]++
+	}
+	// b starts with 10% of its weight
+	if count["b"] < 5 || count["b"] > 15 {
+		t.Fatalf("unexpected distribution: %v", count)
+	}
+
+	for _, ep := range entry.endpoints {
+		if ep.name == "b" {
+			if w := ep.effectiveWeight(now + int64(5*time.Second)); w != slowStartScale/2 {
+				t.Fatalf("unexpected weight halfway: %d", w)
+			}
+			if w := ep.effectiveWeight(now + int64(10*time.Second)); w != slowStartScale {
+				t.Fatalf("unexpected weight after slow start: %d", w)
+			}
+		}
+	}
+	if entry.warming(now + int64(10*time.Second)) {
+		t.Fatal("service still warming after slow start")
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+
+	svr := newTestService(map[string]int{"a": 1})
+	a, _ := svr.ep.Load("a")
+	a.port = ln.Addr().(*net.TCPAddr).Port
+	svr.maxConns = 2
+	pools := newConnPoolMap()
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+	pools.attach(svr, entry)
+	ep := entry.endpoints[0]
+	if ep.client == nil || ep.client.MaxConns != 2 || ep.client.Addr != string(ep.addr) {
+		t.Fatalf("unexpected client: %+v", ep.client)
+	}
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI("http://" + string(ep.addr) + "/")
+	if err := ep.doTimeout(req, res, time.Second); err != nil || string(res.Body()) != "ok" {
+		t.Fatalf("unexpected response: %s, err: %v", res.Body(), err)
+	}
+	if info, ok := pools.info("a"); !ok || info.MaxConns != 2 || info.Pending != 0 {
+		t.Fatalf("unexpected pool info: %+v", info)
+	}
+
+	// a new limit is applied in place, a new idle duration replaces the pool
+	client := ep.client
+	svr.maxConns = 4
+	entry = newServiceEntry(svr, newEndpointStatsMap())
+	pools.attach(svr, entry)
+	if entry.endpoints[0].client != client || client.MaxConns != 4 {
+		t.Fatalf("pool not updated in place")
+	}
+	svr.maxIdleConnDuration = time.Second
+	entry = newServiceEntry(svr, newEndpointStatsMap())
+	pools.attach(svr, entry)
+	if entry.endpoints[0].client == client || entry.endpoints[0].client.MaxIdleConnDuration != time.Second {
+		t.Fatalf("pool not replaced")
+	}
+	// the idle connections of a replaced or dropped pool are closed
+	if client.ConnsCount() != 0 {
+		t.Fatalf("connections of the replaced pool left open: %d", client.ConnsCount())
+	}
+	ep = entry.endpoints[0]
+	if err := ep.doTimeout(req, res, time.Second); err != nil || ep.client.ConnsCount() != 1 {
+		t.Fatalf("unexpected connections: %d, err: %v", ep.client.ConnsCount(), err)
+	}
+
+	pools.Retain(func(key EndpointNameString) bool { return false })
+	if _, ok := pools.Load("a"); ok {
+		t.Fatal("pool not removed")
+	}
+	if ep.client.ConnsCount() != 0 {
+		t.Fatalf("connections of the dropped pool left open: %d", ep.client.ConnsCount())
+	}
+}
@@ -0,0 +1,78 @@
+package routing
+
+import (
+	"bytes"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
+	"github.com/hhjpin/goutils/errors"
+	"regexp"
+)
+
+var (
+	// named types usable as `:name<type>`
+	paramTypes = map[string]string{
+		"int":   `-?[0-9]+`,
+		"uint":  `[0-9]+`,
+		"alpha": `[a-zA-Z]+`,
+		"alnum": `[a-zA-Z0-9]+`,
+		"hex":   `[0-9a-fA-F]+`,
+		"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	}
+)
+
+// newFrontendApi parses the frontend api and compiles the constraints of its path parameters. A parameter can be
+// constrained by a regular expression `:id{[0-9]+}` or by a named type `:id<int>`, the expression must match the
+// whole segment and can not contain `/`.
+func newFrontendApi(path []byte) (*FrontendApi, error) {
+	api := &FrontendApi{
+		path:       path,
+		pathString: FrontendApiString(path),
+		pattern:    bytes.Split(path, constant.SlashBytes),
+	}
+	api.constraints = make([]*regexp.Regexp, len(api.pattern))
+	for idx, seg := range api.pattern {
+		if !bytes.HasPrefix(seg, VariableIdentifier) {
+			continue
+		}
+		constraint, err := compileConstraint(seg)
+		if err != nil {
+			return nil, err
+		}
+		api.constraints[idx] = constraint
+	}
+	return api, nil
+}
+
+func compileConstraint(seg []byte) (*regexp.Regexp, error) {
+	var expr string
+	if start := bytes.IndexByte(seg, '{'); start > 0 {
+		if !bytes.HasSuffix(seg, []byte("}")) {
+			return nil, errors.NewFormat(200, fmt.Sprintf("unclosed parameter constraint: %s", seg))
+		}
+		expr = string(seg[start+1 : len(seg)-1])
+	} else if start := bytes.IndexByte(seg, '<'); start > 0 {
+		if !bytes.HasSuffix(seg, []byte(">")) {
+			return nil, errors.NewFormat(200, fmt.Sprintf("unclosed parameter type: %s", seg))
+		}
+		typ := string(seg[start+1 : len(seg)-1])
+		var ok bool
+		if expr, ok = paramTypes[typ]; !ok {
+			return nil, errors.NewFormat(200, fmt.Sprintf("unsupported parameter type: %s", typ))
+		}
+	} else {
+		return nil, nil
+	}
+	constraint, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, errors.NewFormat(200, fmt.Sprintf("invalid parameter constraint %s: %s", seg, err))
+	}
+	return constraint, nil
+}
+
+// paramName strips the constraint of a path parameter, `:id{[0-9]+}` and `:id<int>` both return `:id`
+func paramName(seg []byte) []byte {
+	if idx := bytes.IndexAny(seg, "{<"); idx > 0 {
+		return seg[:idx]
+	}
+	return seg
+}
@@ -0,0 +1,157 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
+	"git.henghajiang.com/backend/api_gateway_v2/core/utils"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/hhjpin/goutils/logger"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// ttl of the drain reports in seconds, the reports of a stopped gateway expire with its lease
+	drainReportTTL = 10
+)
+
+// drainReporter tells draining nodes how many of their requests are still in flight in this gateway. Every gateway
+// writes its own count to `/Drain/Node-x/<instance>` once per tick while the endpoint is draining, the node may
+// shut down once every report is 0. The reports are bound to a lease kept alive by the reporting ticks.
+// The counts are taken by the event goroutine and written by the reporter goroutine, so a slow etcd does not delay
+// the events.
+type drainReporter struct {
+	cli      *clientv3.Client
+	instance string
+	// in-flight requests of the draining endpoints keyed by the endpoint id, only the latest snapshot is pending
+	snapshots chan map[string]int64
+
+	// used by the reporter goroutine only
+	lease clientv3.LeaseID
+	// last count written for each draining endpoint, keyed by the endpoint id
+	reported map[string]int64
+}
+
+func newDrainReporter(cli *clientv3.Client) *drainReporter {
+	host, err := os.Hostname()
+	if err != nil {
+		logger.Error(err)
+		host = "unknown-host"
+	}
+	return &drainReporter{
+		cli:       cli,
+		instance:  fmt.Sprintf("%s:%d", host, conf.Conf.Server.ListenPort),
+		snapshots: make(chan map[string]int64, 1),
+		reported:  make(map[string]int64),
+	}
+}
+
+func (d *drainReporter) key(id string) string {
+	return constant.DrainPrefixDefinition + id + constant.Slash + d.instance
+}
+
+// reportDraining hands the in-flight requests of the draining endpoints to the reporter goroutine, it is called by
+// the event goroutine on every health check tick
+func (r *Table) reportDraining() {
+	d := r.drain
+	if d == nil {
+		return
+	}
+	draining := make(map[string]int64)
+	r.endpointTable.Range(func(key EndpointNameString, value *Endpoint) bool {
+		if value.status == Draining {
+			var inflight int64
+			if stats, ok := r.stats.Load(key); ok {
+				inflight = stats.outstanding()
+			}
+			draining[value.id] = inflight
+		}
+		return false
+	})
+	for {
+		select {
+		case d.snapshots <- draining:
+			return
+		default:
+		}
+		// the reporter is still writing, the pending snapshot is stale
+		select {
+		case <-d.snapshots:
+		default:
+		}
+	}
+}
+
+// run writes the snapshots of the event goroutine, it never returns
+func (d *drainReporter) run() {
+	for draining := range d.snapshots {
+		d.report(draining)
+	}
+}
+
+// report writes the in-flight requests of the draining endpoints, reports of endpoints which stopped draining or
+// were deleted are removed
+func (d *drainReporter) report(draining map[string]int64) {
+	for id := range d.reported {
+		if _, ok := draining[id]; !ok {
+			delete(d.reported, id)
+			if err := d.delete(id); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+	if len(draining) == 0 {
+		return
+	}
+	if !d.keepAlive() {
+		return
+	}
+	for id, inflight := range draining {
+		if last, ok := d.reported[id]; ok && last == inflight {
+			continue
+		}
+		if _, err := utils.PutKV(d.cli, d.key(id), strconv.FormatInt(inflight, 10), clientv3.WithLease(d.lease)); err != nil {
+			logger.Error(err)
+			continue
+		}
+		d.reported[id] = inflight
+	}
+}
+
+// keepAlive renews the lease of the reports, a new lease is granted when it expired and every report is written
+// again
+func (d *drainReporter) keepAlive() bool {
+	if d.cli == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if d.lease != clientv3.NoLease {
+		if _, err := d.cli.KeepAliveOnce(ctx, d.lease); err == nil {
+			return true
+		}
+		logger.Warnf("drain report lease %d lost, granting a new one", d.lease)
+	}
+	resp, err := d.cli.Grant(ctx, drainReportTTL)
+	if err != nil {
+		logger.Error(err)
+		d.lease = clientv3.NoLease
+		return false
+	}
+	d.lease = resp.ID
+	d.reported = make(map[string]int64)
+	return true
+}
+
+func (d *drainReporter) delete(id string) error {
+	if d.cli == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := d.cli.Delete(ctx, d.key(id))
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
 	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
 	"git.henghajiang.com/backend/api_gateway_v2/core/utils"
 	"github.com/coreos/etcd/clientv3"
@@ -11,6 +12,8 @@ import (
 	"github.com/hhjpin/goutils/logger"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func InitRoutingTable(cli *clientv3.Client) *Table {
@@ -19,7 +22,21 @@ func InitRoutingTable(cli *clientv3.Client) *Table {
 
 	rt.cli = cli
 	rt.Version = "1.0.0"
+	for _, domain := range conf.Conf.Server.ListenDomainName {
+		rt.listenDomain = append(rt.listenDomain, strings.ToLower(strings.TrimSpace(domain)))
+	}
+	rt.retry = newRetryPolicy()
+	rt.stats = newEndpointStatsMap()
+	rt.balances = newServiceBalanceMap()
+	rt.pools = newConnPoolMap()
+	rt.outlier = newOutlierDetector()
+	rt.mirror = newMirrorer(rt.outlier)
+	rt.stream = newStreamer(rt.outlier)
+	rt.webSocket = newWebSocketProxy(rt.outlier)
 	rt.events = NewEvents()
+	rt.checks = make(map[EndpointNameString]*healthCheckState)
+	rt.drain = newDrainReporter(cli)
+	go rt.drain.run()
 	ol := NewOnlineRouteTableMap()
 	svrMap, epMap, err := initServiceNode(cli)
 	if err != nil {
@@ -37,38 +54,24 @@ func InitRoutingTable(cli *clientv3.Client) *Table {
 	rt.routerTable = *routerTable
 
 	rt.endpointTable.Range(func(key EndpointNameString, value *Endpoint) bool {
-		if value.healthCheck.path != nil {
+		if value.healthCheck.path != nil && value.status != Draining {
 			epSlice = append(epSlice, value)
 		}
 		return false
 	})
-	if len(epSlice) > 0 {
-		for _, ep := range epSlice {
-			if check, err := ep.healthCheck.Check(ep.host, ep.port); check {
-				if err = rt.SetEndpointOnline(ep); err != nil {
-					ep.setStatus(Online)
-				}
-			} else {
-				if err = rt.SetEndpointStatus(ep, BreakDown); err != nil {
-					ep.setStatus(BreakDown)
-				}
-			}
-		}
+	// the endpoints start with the status stored in etcd, the results are applied once the events are handled
+	now := time.Now()
+	for _, ep := range epSlice {
+		rt.startHealthCheck(ep, now)
 	}
 	rt.routerTable.Range(func(key RouterNameString, value *Router) {
-		var ok bool
 		if value.CheckStatus(Online) {
-			ok, _ = rt.SetRouterStatus(value, Online)
+			_, _ = rt.SetRouterStatus(value, Online)
 		} else {
-			ok, _ = rt.SetRouterStatus(value, Offline)
-		}
-		if ok {
-			confirm, _ := value.service.checkEndpointStatus(Online)
-			if err := value.service.ResetOnlineEndpointRing(confirm); err != nil {
-				logger.Error(err.(errors.Error).String(), " ", key, " ", value.frontendApi.pathString)
-			}
+			_, _ = rt.SetRouterStatus(value, Offline)
 		}
 	})
+	rt.publish()
 	return &rt
 }
 
@@ -123,6 +126,10 @@ func initServiceNode(cli *clientv3.Client) (*ServiceTableMap, *EndpointTableMap,
 						epMap.Store(key, value)
 						return false
 					})
+				} else if ok, err := s.setAttr(string(tmp[1]), kv.Value); ok {
+					if err != nil {
+						logger.Errorf("invalid service attribute, key: %s, err: %s", string(kv.Key), err)
+					}
 				} else {
 					logger.Warnf("unrecognized node attribute, key: %s, value: %s", string(kv.Key), string(kv.Value))
 				}
@@ -133,7 +140,6 @@ func initServiceNode(cli *clientv3.Client) (*ServiceTableMap, *EndpointTableMap,
 							name:       sName,
 							nameString: ServiceNameString(sName),
 							ep:         nil,
-							onlineEp:   nil,
 						}
 						svrMap.Store(ServiceNameString(sName), s)
 					} else {
@@ -147,7 +153,6 @@ func initServiceNode(cli *clientv3.Client) (*ServiceTableMap, *EndpointTableMap,
 						name:       sName,
 						nameString: ServiceNameString(sName),
 						ep:         nil,
-						onlineEp:   nil,
 					}
 					err = json.Unmarshal(kv.Value, &nodeSlice)
 					if err != nil {
@@ -168,6 +173,16 @@ func initServiceNode(cli *clientv3.Client) (*ServiceTableMap, *EndpointTableMap,
 						epMap.Store(key, value)
 						return false
 					})
+				} else if isServiceAttr(string(tmp[1])) {
+					s = &Service{
+						name:       sName,
+						nameString: ServiceNameString(sName),
+						ep:         nil,
+					}
+					if _, err := s.setAttr(string(tmp[1]), kv.Value); err != nil {
+						logger.Errorf("invalid service attribute, key: %s, err: %s", string(kv.Key), err)
+					}
+					svrMap.Store(s.nameString, s)
 				} else {
 					logger.Warnf("unrecognized node attribute, key: %s, value: %s", string(kv.Key), string(kv.Value))
 				}
@@ -179,6 +194,7 @@ func initServiceNode(cli *clientv3.Client) (*ServiceTableMap, *EndpointTableMap,
 
 func initEndpointNode(cli *clientv3.Client, nodeID string) (*Endpoint, error) {
 	var ep Endpoint
+	ep.weight = defaultEndpointWeight
 
 	resp, err := utils.GetPrefixKV(cli, constant.NodePrefixDefinition+nodeID, clientv3.WithPrefix())
 	if err != nil {
@@ -214,9 +230,16 @@ func initEndpointNode(cli *clientv3.Client, nodeID string) (*Endpoint, error) {
 				ep.status = Online
 			case BreakDown:
 				ep.status = BreakDown
+			case Draining:
+				ep.status = Draining
 			default:
 				return nil, errors.New(150)
 			}
+		} else if bytes.Equal(key, constant.WeightKeyBytes) {
+			if ep.weight, err = parseWeight(kv.Value); err != nil {
+				logger.Error(err)
+				return nil, err
+			}
 		} else if bytes.Equal(key, []byte(constant.FailedTimesKeyString)) {
 			// do nothing
 		} else if bytes.Equal(key, constant.HealthCheckKeyBytes) {
@@ -267,12 +290,22 @@ func initEndpointNode(cli *clientv3.Client, nodeID string) (*Endpoint, error) {
 						return nil, err
 					}
 					hc.retryTime = uint8(tmpInt)
+				} else if ok, err := hc.setAttr(string(keyA), kvA.Value); ok {
+					if err != nil {
+						logger.Error(err)
+						return nil, err
+					}
 				} else {
 					// unrecognized attribute
 					logger.Warnf("unrecognized health check attribute, key: %s, value: %s", string(kvA.Key), string(kvA.Value))
 				}
 			}
 			ep.healthCheck = &hc
+		} else if ok, err := ep.setAttr(string(key), kv.Value); ok {
+			if err != nil {
+				logger.Error(err)
+				return nil, err
+			}
 		} else {
 			logger.Warnf("unrecognized node attribute, key: %s, value: %s", string(kv.Key), string(kv.Value))
 		}
@@ -288,6 +321,7 @@ func initEndpointNode(cli *clientv3.Client, nodeID string) (*Endpoint, error) {
 func initRouter(cli *clientv3.Client, svrMap *ServiceTableMap) (*RouterTableMap, *ApiRouterTableMap, error) {
 	rtMap := NewRouteTableMap()
 	artMap := NewApiRouterTableMap()
+	invalid := make(map[RouterNameString]bool)
 
 	resp, err := utils.GetPrefixKV(cli, constant.RouterDefinition, clientv3.WithPrefix())
 	if err != nil {
@@ -317,10 +351,14 @@ func initRouter(cli *clientv3.Client, svrMap *ServiceTableMap) (*RouterTableMap,
 				}
 				r.name = kv.Value
 			} else if bytes.Equal(attr, constant.FrontendApiKeyBytes) {
-				r.frontendApi = &FrontendApi{
-					path:       kv.Value,
-					pathString: FrontendApiString(kv.Value),
-					pattern:    bytes.Split(kv.Value, constant.SlashBytes),
+				if r.frontendApi, err = newFrontendApi(kv.Value); err != nil {
+					logger.Errorf("invalid router frontend api, key: %s, err: %s", string(kv.Key), err)
+					invalid[RouterNameString(rName)] = true
+				}
+			} else if ok, err := r.setAttr(string(attr), kv.Value); ok {
+				if err != nil {
+					logger.Errorf("invalid router attribute, key: %s, err: %s", string(kv.Key), err)
+					invalid[RouterNameString(rName)] = true
 				}
 			} else if bytes.Equal(attr, constant.BackendApiKeyBytes) {
 				r.backendApi = &BackendApi{
@@ -349,7 +387,12 @@ func initRouter(cli *clientv3.Client, svrMap *ServiceTableMap) (*RouterTableMap,
 			logger.Errorf("route %s: not have total attr: frontendApi", key)
 			return
 		}
-		artMap.Store(value.frontendApi.pathString, value)
+		if invalid[key] {
+			delete(rtMap.internal, key)
+			logger.Errorf("route %s: invalid attribute, skipped", key)
+			return
+		}
+		artMap.Store(key, value)
 	})
 	return rtMap, artMap, nil
 }
@@ -371,10 +414,9 @@ func (r *Table) CreateRouter(name string, key string) error {
 		switch keyStr {
 		case constant.IdKeyString:
 		case constant.FrontendApiKeyString:
-			router.frontendApi = &FrontendApi{
-				path:       kv.Value,
-				pathString: FrontendApiString(kv.Value),
-				pattern:    bytes.Split(kv.Value, constant.SlashBytes),
+			if router.frontendApi, err = newFrontendApi(kv.Value); err != nil {
+				logger.Error(err)
+				return err
 			}
 		case constant.BackendApiKeyString:
 			router.backendApi = &BackendApi{
@@ -391,7 +433,6 @@ func (r *Table) CreateRouter(name string, key string) error {
 					name:             kv.Value,
 					nameString:       ServiceNameString(kv.Value),
 					ep:               NewEndpointTableMap(),
-					onlineEp:         nil,
 					acceptHttpMethod: nil,
 				}
 			} else {
@@ -399,8 +440,13 @@ func (r *Table) CreateRouter(name string, key string) error {
 			}
 		case constant.StatusKeyString:
 		default:
-			logger.Errorf("unsupported router attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported router attribute: %s", keyStr))
+			if ok, err := router.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported router attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported router attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return err
+			}
 		}
 	}
 
@@ -409,14 +455,10 @@ func (r *Table) CreateRouter(name string, key string) error {
 		return errors.New(126)
 	}
 
-	r.table.Store(router.frontendApi.pathString, router)
+	r.table.Store(RouterNameString(router.name), router)
 	r.routerTable.Store(RouterNameString(router.name), router)
 	confirm, _ := router.service.checkEndpointStatus(Online)
 	if len(confirm) > 0 {
-		if err := router.service.ResetOnlineEndpointRing(confirm); err != nil {
-			logger.Error(err)
-			return err
-		}
 		if _, err := r.SetRouterOnline(router); err != nil {
 			logger.Error(err)
 			return err
@@ -447,6 +489,8 @@ func (r *Table) RefreshRouter(router *Router, key string) error {
 
 		//return errors.New(132)
 	}
+	// optional attributes are assigned after parsing, absent keys mean they have been deleted
+	opt := &Router{}
 	for _, kv := range resp.Kvs {
 		key := bytes.TrimPrefix(kv.Key, []byte(key))
 		if bytes.Contains(key, constant.SlashBytes) {
@@ -458,12 +502,15 @@ func (r *Table) RefreshRouter(router *Router, key string) error {
 		case constant.IdKeyString:
 		case constant.FrontendApiKeyString:
 			if !bytes.Equal(router.frontendApi.path, kv.Value) {
-				tmp := router.frontendApi.pathString
-				router.frontendApi.path = kv.Value
-				router.frontendApi.pathString = FrontendApiString(kv.Value)
-				router.frontendApi.pattern = bytes.Split(kv.Value, constant.SlashBytes)
-				r.table.Store(FrontendApiString(kv.Value), router)
-				r.table.Delete(tmp)
+				api, err := newFrontendApi(kv.Value)
+				if err != nil {
+					logger.Error(err)
+					return err
+				}
+				router.frontendApi.path = api.path
+				router.frontendApi.pathString = api.pathString
+				router.frontendApi.pattern = api.pattern
+				router.frontendApi.constraints = api.constraints
 			}
 		case constant.BackendApiKeyString:
 			router.backendApi.path = kv.Value
@@ -478,7 +525,6 @@ func (r *Table) RefreshRouter(router *Router, key string) error {
 					name:             kv.Value,
 					nameString:       ServiceNameString(kv.Value),
 					ep:               NewEndpointTableMap(),
-					onlineEp:         nil,
 					acceptHttpMethod: nil,
 				}
 			} else {
@@ -486,16 +532,18 @@ func (r *Table) RefreshRouter(router *Router, key string) error {
 			}
 		case constant.StatusKeyString:
 		default:
-			logger.Errorf("unsupported router attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported router attribute: %s", keyStr))
+			if ok, err := opt.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported router attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported router attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return err
+			}
 		}
 	}
+	router.copyAttrs(opt)
 	confirm, _ := router.service.checkEndpointStatus(Online)
 	if len(confirm) > 0 {
-		if err := router.service.ResetOnlineEndpointRing(confirm); err != nil {
-			logger.Error(err)
-			return err
-		}
 		if _, err := r.SetRouterOnline(router); err != nil {
 			logger.Error(err)
 			return err
@@ -510,7 +558,7 @@ func (r *Table) DeleteRouter(name string) error {
 		// router already deleted
 		return nil
 	}
-	r.table.Delete(router.frontendApi.pathString)
+	r.table.Delete(RouterNameString(router.name))
 	r.routerTable.Delete(RouterNameString(router.name))
 	r.onlineTable.Delete(router.frontendApi)
 	logger.Debugf("route delete successful: %s", name)
@@ -547,18 +595,17 @@ func (r *Table) CreateService(name string, key string) error {
 					svr.ep.Store(ep.nameString, ep)
 				}
 			}
-			confirm, _ := svr.checkEndpointStatus(Online)
-			if len(confirm) > 0 {
-				if err := svr.ResetOnlineEndpointRing(confirm); err != nil {
-					logger.Error(err)
-				}
-			}
 		case constant.NameKeyString:
 			svr.name = kv.Value
 			svr.nameString = ServiceNameString(kv.Value)
 		default:
-			logger.Errorf("unsupported service attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			if ok, err := svr.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported service attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return err
+			}
 		}
 	}
 	r.serviceTable.Store(svr.nameString, svr)
@@ -620,25 +667,29 @@ func (r *Table) RefreshService(ori *Service, key string) error {
 					svr.ep.Store(ep.nameString, ep)
 				}
 			}
-			confirm, _ := svr.checkEndpointStatus(Online)
-			if len(confirm) > 0 {
-				if err := svr.ResetOnlineEndpointRing(confirm); err != nil {
-					logger.Error(err)
-				}
-			}
 		case constant.NameKeyString:
 			svr.name = kv.Value
 			svr.nameString = ServiceNameString(kv.Value)
 		default:
-			logger.Errorf("unsupported service attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			if ok, err := svr.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported service attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return err
+			}
 		}
 	}
 	ori.name = svr.name
 	ori.nameString = svr.nameString
 	ori.acceptHttpMethod = svr.acceptHttpMethod
+	ori.timeout = svr.timeout
+	ori.loadBalancer = svr.loadBalancer
+	ori.hashKey = svr.hashKey
+	ori.slowStart = svr.slowStart
+	ori.maxConns = svr.maxConns
+	ori.maxIdleConnDuration = svr.maxIdleConnDuration
 	ori.ep = svr.ep
-	ori.onlineEp = svr.onlineEp
 	logger.Debugf("refresh service: %s", ori.nameString)
 
 	r.routerTable.Range(func(key RouterNameString, value *Router) {
@@ -692,7 +743,7 @@ func (r *Table) CreateEndpoint(id string, key string) error {
 		logger.Error(err)
 		return err
 	}
-	ep := &Endpoint{}
+	ep := &Endpoint{weight: defaultEndpointWeight}
 	for _, kv := range resp.Kvs {
 		key := bytes.TrimPrefix(kv.Key, []byte(key))
 		if bytes.Contains(key, constant.SlashBytes) {
@@ -722,6 +773,11 @@ func (r *Table) CreateEndpoint(id string, key string) error {
 				return err
 			}
 			ep.port = int(tmp)
+		case constant.WeightKeyString:
+			if ep.weight, err = parseWeight(kv.Value); err != nil {
+				logger.Error(err)
+				return err
+			}
 		case constant.FailedTimesKeyString:
 			// do nothing
 		case constant.StatusKeyString:
@@ -734,20 +790,20 @@ func (r *Table) CreateEndpoint(id string, key string) error {
 				ep.healthCheck = hc
 			}
 		default:
-			logger.Errorf("unsupported service attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			if ok, err := ep.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported service attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return err
+			}
 		}
 	}
+	r.endpointTable.Store(ep.nameString, ep)
 	if ep.healthCheck != nil {
-		if ok, err := ep.healthCheck.Check(ep.host, ep.port); err != nil {
-			ep.setStatus(Offline)
-		} else if !ok {
-			ep.setStatus(BreakDown)
-		} else {
-			ep.setStatus(Online)
-		}
+		// the endpoint stays offline until its first check succeeds
+		r.startHealthCheck(ep, time.Now())
 	}
-	r.endpointTable.Store(ep.nameString, ep)
 
 	flag := false
 	r.serviceTable.Range(func(key ServiceNameString, value *Service) bool {
@@ -759,6 +815,8 @@ func (r *Table) CreateEndpoint(id string, key string) error {
 			ori.host = ep.host
 			ori.id = ep.id
 			ori.status = ep.status
+			ori.weight = ep.weight
+			ori.copyAttrs(ep)
 			flag = true
 			return true
 		}
@@ -828,7 +886,7 @@ func (r *Table) RefreshEndpoint(oriEp *Endpoint, key string) error {
 		logger.Error(err)
 		return err
 	}
-	ep := &Endpoint{}
+	ep := &Endpoint{weight: defaultEndpointWeight}
 	for _, kv := range resp.Kvs {
 		key := bytes.TrimPrefix(kv.Key, []byte(key))
 		if bytes.Contains(key, constant.SlashBytes) {
@@ -858,6 +916,11 @@ func (r *Table) RefreshEndpoint(oriEp *Endpoint, key string) error {
 				return err
 			}
 			ep.port = int(tmp)
+		case constant.WeightKeyString:
+			if ep.weight, err = parseWeight(kv.Value); err != nil {
+				logger.Error(err)
+				return err
+			}
 		case constant.FailedTimesKeyString:
 			// do nothing
 		case constant.StatusKeyString:
@@ -875,30 +938,32 @@ func (r *Table) RefreshEndpoint(oriEp *Endpoint, key string) error {
 				ep.healthCheck = hc
 			}
 		default:
-			logger.Errorf("unsupported service attribute: %s", keyStr)
-			return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
-		}
-	}
-	if ep.healthCheck != nil {
-		if ok, err := ep.healthCheck.Check(ep.host, ep.port); err != nil || !ok {
-			if newStatus == BreakDown {
-				ep.setStatus(BreakDown)
-			} else {
-				ep.setStatus(Offline)
-			}
-		} else {
-			ep.setStatus(Online)
-		}
-		if oriEp.status != ep.status {
-			if err := r.SetEndpointStatus(oriEp, ep.status); err != nil {
+			if ok, err := ep.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported service attribute: %s", keyStr)
+				return errors.NewFormat(200, fmt.Sprintf("unsupported service attribute: %s", keyStr))
+			} else if err != nil {
 				logger.Error(err)
+				return err
 			}
 		}
+	}
+	// the status is taken from etcd, a draining node leaves the balancers whatever its health is and whether it is
+	// checked or not
+	ep.setStatus(newStatus)
+	recheck := false
+	if ep.healthCheck != nil {
+		// the node is checked again when its status was not written by the checks (e.g. it registered again) or its
+		// address changed, the status written by the checks themselves is not checked again
+		recheck = newStatus != Draining && (newStatus != oriEp.status || !bytes.Equal(ep.host, oriEp.host) ||
+			ep.port != oriEp.port || ep.scheme != oriEp.scheme)
 		oriEp.healthCheck = ep.healthCheck
 		oriEp.port = ep.port
 		oriEp.host = ep.host
 		oriEp.rate = ep.rate
 	}
+	oriEp.setStatus(ep.status)
+	oriEp.weight = ep.weight
+	oriEp.copyAttrs(ep)
 
 	r.serviceTable.Range(func(key ServiceNameString, value *Service) bool {
 		if ori, ok := value.ep.Load(ep.nameString); ok {
@@ -909,6 +974,8 @@ func (r *Table) RefreshEndpoint(oriEp *Endpoint, key string) error {
 			ori.host = ep.host
 			ori.id = ep.id
 			ori.status = ep.status
+			ori.weight = ep.weight
+			ori.copyAttrs(ep)
 
 			if err := r.RefreshService(value, fmt.Sprintf("/Service/Service-%s/", value.nameString)); err != nil {
 				logger.Error(err)
@@ -916,6 +983,9 @@ func (r *Table) RefreshEndpoint(oriEp *Endpoint, key string) error {
 		}
 		return false
 	})
+	if recheck {
+		r.startHealthCheck(oriEp, time.Now())
+	}
 	return nil
 }
 
@@ -947,12 +1017,13 @@ func (r *Table) RefreshHealthCheck(id string, key string) error {
 		return err
 	}
 	r.endpointTable.Range(func(key EndpointNameString, value *Endpoint) bool {
-		if value.healthCheck.id == hc.id {
+		if value.healthCheck != nil && value.healthCheck.id == hc.id {
 			value.healthCheck.path = hc.path
 			value.healthCheck.retry = hc.retry
 			value.healthCheck.retryTime = hc.retryTime
 			value.healthCheck.interval = hc.interval
 			value.healthCheck.timeout = hc.timeout
+			value.healthCheck.copyAttrs(hc)
 
 			if err = r.RefreshEndpoint(value, fmt.Sprintf("/Node/Node-%s/", value.id)); err != nil {
 				logger.Error(err)
@@ -1020,8 +1091,13 @@ func CreateHealthCheck(cli *clientv3.Client, id string, key string) (*HealthChec
 			}
 			hc.timeout = uint8(tmp)
 		default:
-			logger.Errorf("unsupported health-check attribute: %s", keyStr)
-			return nil, errors.NewFormat(200, fmt.Sprintf("unsupported health-check attribute: %s", keyStr))
+			if ok, err := hc.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported health-check attribute: %s", keyStr)
+				return nil, errors.NewFormat(200, fmt.Sprintf("unsupported health-check attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return nil, err
+			}
 		}
 	}
 	return hc, nil
@@ -1083,8 +1159,13 @@ func RefreshHealthCheck(cli *clientv3.Client, id string, key string) (*HealthChe
 			}
 			hc.timeout = uint8(tmp)
 		default:
-			logger.Errorf("unsupported health-check attribute: %s", keyStr)
-			return nil, errors.NewFormat(200, fmt.Sprintf("unsupported health-check attribute: %s", keyStr))
+			if ok, err := hc.setAttr(keyStr, kv.Value); !ok {
+				logger.Errorf("unsupported health-check attribute: %s", keyStr)
+				return nil, errors.NewFormat(200, fmt.Sprintf("unsupported health-check attribute: %s", keyStr))
+			} else if err != nil {
+				logger.Error(err)
+				return nil, err
+			}
 		}
 	}
 	return hc, nil
@@ -10,6 +10,17 @@ type WatchMsgFunc func()
 
 type WatchMsg struct {
 	Handle WatchMsgFunc
+	// Check is run instead of Handle by the results of the health checks, it reports whether the tables changed
+	Check func() bool
+}
+
+// handle runs the handler of the message and reports whether the tables have to be published again
+func (m *WatchMsg) handle() bool {
+	if m.Check != nil {
+		return m.Check()
+	}
+	m.Handle()
+	return true
 }
 
 type Events struct {
@@ -36,28 +47,32 @@ func (r *Table) HandleEvent() {
 		go r.HandleEvent()
 	}()
 
-	hcInterval := time.Second * 10
-	timer := time.NewTimer(hcInterval)
+	ticker := time.NewTicker(healthCheckTick)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-timer.C:
-			r.doHealthCheck()
-			timer.Reset(hcInterval)
+		case now := <-ticker.C:
+			r.scheduleHealthCheck(now)
+			r.reportDraining()
 		case msg := <-r.events.watchCh:
-			r.handleWatchEvent(&msg)
+			if r.handleWatchEvent(&msg) {
+				r.publish()
+			}
 		}
 	}
 }
 
 //do more watch event
-func (r *Table) handleWatchEvent(msg *WatchMsg) {
-	msg.Handle()
+func (r *Table) handleWatchEvent(msg *WatchMsg) bool {
+	changed := msg.handle()
 	for {
 		select {
 		case msg := <-r.events.watchCh:
-			msg.Handle()
+			if msg.handle() {
+				changed = true
+			}
 		default:
-			return
+			return changed
 		}
 	}
 }
@@ -0,0 +1,48 @@
+package routing
+
+import (
+	"bytes"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, 6.1, they only apply to a single connection and are not
+// forwarded by the proxy
+var hopHeaders = [][]byte{
+	[]byte("Connection"),
+	[]byte("Keep-Alive"),
+	[]byte("Proxy-Connection"),
+	[]byte("Proxy-Authenticate"),
+	[]byte("Proxy-Authorization"),
+	[]byte("Te"),
+	[]byte("Trailer"),
+	[]byte("Transfer-Encoding"),
+	[]byte("Upgrade"),
+}
+
+// hopFilter reports the hop-by-hop headers of a message, including the ones listed by its Connection header
+type hopFilter struct {
+	connection [][]byte
+}
+
+func newHopFilter(connection []byte) hopFilter {
+	var f hopFilter
+	for _, token := range bytes.Split(connection, []byte(",")) {
+		if token = bytes.TrimSpace(token); len(token) > 0 {
+			f.connection = append(f.connection, token)
+		}
+	}
+	return f
+}
+
+func (f hopFilter) isHop(key []byte) bool {
+	for _, h := range hopHeaders {
+		if bytes.EqualFold(key, h) {
+			return true
+		}
+	}
+	for _, h := range f.connection {
+		if bytes.EqualFold(key, h) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,43 @@ package routing
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
 	"git.henghajiang.com/backend/api_gateway_v2/core/utils"
 	"github.com/hhjpin/goutils/errors"
 	"github.com/hhjpin/goutils/logger"
 	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	// granularity of the health check scheduler
+	healthCheckTick = time.Second
+
+	// values of the `Type` attribute of health checks
+	tcpHealthCheck   = "tcp"
+	httpHealthCheck  = "http"
+	httpsHealthCheck = "https"
+	grpcHealthCheck  = "grpc"
+)
+
+var (
+	// endpoints without tls options are checked by address, their certificates are issued for service names and can
+	// not be verified
+	healthCheckTLSConfig = &tls.Config{InsecureSkipVerify: true}
 )
 
 type HealthCheck struct {
@@ -16,13 +46,171 @@ type HealthCheck struct {
 	path []byte
 
 	// timeout default is 5 sec. When timed out, will retry to check again based on 'retry' switch on or not
-	timeout   uint8
-	interval  uint8
-	retry     bool
+	timeout  uint8
+	interval uint8
+	// a failed check is attempted once more right away before it counts as failed
+	retry bool
+	// failed checks in a row tolerated before the endpoint is set offline
 	retryTime uint8
+	// prober of the check, http when empty. The path is the service name of grpc checks and unused by tcp checks
+	typ string
+
+	// optional request and assertions of http checks, a 2xx/3xx status is healthy when expectStatus is empty
+	method       []byte
+	host         []byte
+	headers      map[string]string
+	expectStatus []int
+	bodyContains []byte
+	bodyRegex    *regexp.Regexp
+}
+
+// healthCheckState is the schedule of the health check of an endpoint, it is only used by the event goroutine but
+// for running, which the check clears itself when its result does not change the endpoint
+type healthCheckState struct {
+	next time.Time
+	// a check is in flight (1), the endpoint is not scheduled again until its result is applied
+	running int32
+}
+
+func (s *healthCheckState) isRunning() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// intervalDuration returns the interval between two checks, 10 sec when not set
+func (h *HealthCheck) intervalDuration() time.Duration {
+	if h.interval == 0 {
+		return defaultHealthCheckInterval
+	}
+	return time.Duration(h.interval) * time.Second
+}
+
+// timeoutDuration returns the timeout of a check, 5 sec when not set
+func (h *HealthCheck) timeoutDuration() time.Duration {
+	if h.timeout == 0 {
+		return defaultHealthCheckTimeout
+	}
+	return time.Duration(h.timeout) * time.Second
+}
+
+// maxFailedTimes returns the failed checks in a row after which the endpoint is set offline. Offline endpoints are
+// still checked on their interval and come back online with the first successful check
+func (h *HealthCheck) maxFailedTimes() int {
+	return int(h.retryTime)
+}
+
+// parseHealthCheckType parses the `Type` attribute of health checks
+func parseHealthCheckType(value []byte) (string, error) {
+	typ := strings.ToLower(strings.TrimSpace(string(value)))
+	switch typ {
+	case tcpHealthCheck, httpHealthCheck, httpsHealthCheck, grpcHealthCheck:
+		return typ, nil
+	}
+	return "", errors.NewFormat(200, fmt.Sprintf("unsupported health check type: %s", string(value)))
+}
+
+// setAttr parses an optional attribute of the health check, false is returned for attributes which are not optional
+func (h *HealthCheck) setAttr(attr string, value []byte) (bool, error) {
+	var err error
+	switch attr {
+	case constant.TypeKeyString:
+		h.typ, err = parseHealthCheckType(value)
+	case constant.MethodKeyString:
+		h.method = bytes.ToUpper(bytes.TrimSpace(value))
+	case constant.HostKeyString:
+		h.host = bytes.ToLower(bytes.TrimSpace(value))
+	case constant.HeadersKeyString:
+		h.headers = nil
+		if len(value) > 0 {
+			err = json.Unmarshal(value, &h.headers)
+		}
+	case constant.ExpectStatusKeyString:
+		h.expectStatus, err = parseExpectStatus(value)
+	case constant.BodyContainsKeyString:
+		h.bodyContains = value
+	case constant.BodyRegexKeyString:
+		h.bodyRegex = nil
+		if len(value) > 0 {
+			h.bodyRegex, err = regexp.Compile(string(value))
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// copyAttrs replaces the optional attributes of the health check with the ones of another
+func (h *HealthCheck) copyAttrs(another *HealthCheck) {
+	h.typ = another.typ
+	h.method = another.method
+	h.host = another.host
+	h.headers = another.headers
+	h.expectStatus = another.expectStatus
+	h.bodyContains = another.bodyContains
+	h.bodyRegex = another.bodyRegex
+}
+
+// parseExpectStatus parses the `ExpectStatus` attribute of health checks, a json list like `[200, 204]`
+func parseExpectStatus(value []byte) ([]int, error) {
+	var status []int
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(value, &status); err != nil {
+		return nil, err
+	}
+	for _, code := range status {
+		if code < 100 || code > 599 {
+			return nil, errors.NewFormat(200, fmt.Sprintf("invalid expected status: %d", code))
+		}
+	}
+	return status, nil
 }
 
+// Check checks the endpoint of a plain http node
 func (h *HealthCheck) Check(host []byte, port int) (bool, error) {
+	return h.checkEndpoint(host, port, "", nil)
+}
+
+// checkEndpoint checks the endpoint with the scheme and tls options of its node. The certificates of `https` checks,
+// and of `grpc` checks of https nodes, are verified with the tls options of the node like the proxied requests. They
+// are not verified for nodes without tls options, which are addressed by ip.
+func (h *HealthCheck) checkEndpoint(host []byte, port int, scheme string, opts *upstreamTLS) (bool, error) {
+	addr := string(host) + ":" + strconv.FormatInt(int64(port), 10)
+	switch h.typ {
+	case tcpHealthCheck:
+		return h.checkTCP(addr)
+	case grpcHealthCheck:
+		if scheme != httpsScheme {
+			return h.checkGRPC(addr, nil)
+		}
+		return h.checkGRPC(addr, checkTLSConfig(opts))
+	case httpsHealthCheck:
+		return h.checkHTTP(addr, httpsScheme, checkTLSConfig(opts))
+	default:
+		return h.checkHTTP(addr, scheme, opts.tlsConfig())
+	}
+}
+
+// checkTLSConfig returns the tls config of the checks of a tls endpoint
+func checkTLSConfig(opts *upstreamTLS) *tls.Config {
+	if opts != nil {
+		return opts.tlsConfig()
+	}
+	return healthCheckTLSConfig
+}
+
+// checkTCP only requires the endpoint to accept connections
+func (h *HealthCheck) checkTCP(addr string) (bool, error) {
+	conn, err := net.DialTimeout("tcp", addr, h.timeoutDuration())
+	if err != nil {
+		logger.Error(err)
+		return false, errors.NewFormat(162, err.Error())
+	}
+	_ = conn.Close()
+	return true, nil
+}
+
+func (h *HealthCheck) checkHTTP(addr string, scheme string, tlsConfig *tls.Config) (bool, error) {
 	if h.path == nil {
 		return false, errors.New(160)
 	}
@@ -34,77 +222,250 @@ func (h *HealthCheck) Check(host []byte, port int) (bool, error) {
 	defer fasthttp.ReleaseResponse(revRes)
 	defer fasthttp.ReleaseURI(revReqUri)
 
-	tmpHost := bytes.Join([][]byte{host, []byte(strconv.FormatInt(int64(port), 10))}, []byte(":"))
-	revReqUri.SetHostBytes(tmpHost)
+	// the host client dials the endpoint whatever the host of the uri is, so the Host header can be set
+	client := &fasthttp.HostClient{
+		Addr:      addr,
+		Name:      "Api Gateway HealthCheck",
+		IsTLS:     scheme == httpsScheme,
+		TLSConfig: tlsConfig,
+	}
+	if len(h.host) > 0 {
+		revReqUri.SetHostBytes(h.host)
+	} else {
+		revReqUri.SetHost(addr)
+	}
 	revReqUri.SetPathBytes(h.path)
-	revReqUri.SetScheme("http")
+	if scheme == httpsScheme {
+		revReqUri.SetScheme(httpsScheme)
+	} else {
+		revReqUri.SetScheme(httpScheme)
+	}
 
 	revReq.SetRequestURIBytes(revReqUri.FullURI())
-	revReq.Header.SetMethodBytes(constant.StrGet)
+	if len(h.method) > 0 {
+		revReq.Header.SetMethodBytes(h.method)
+	} else {
+		revReq.Header.SetMethodBytes(constant.StrGet)
+	}
+	for k, v := range h.headers {
+		revReq.Header.Set(k, v)
+	}
+	revReq.SetConnectionClose()
 	logger.Debugf("check: %s", string(revReqUri.FullURI()))
-	err := fasthttp.Do(revReq, revRes)
+	var err error
+	if scheme == h2cScheme {
+		err = doH2C(addr, revReq, revRes, h.timeoutDuration())
+	} else {
+		err = client.DoTimeout(revReq, revRes, h.timeoutDuration())
+	}
 	if err != nil {
 		logger.Error(err)
 		return false, errors.NewFormat(162, err.Error())
 	}
-	if statusCode := revRes.StatusCode(); statusCode >= 200 && statusCode < 400 {
-		return true, nil
-	} else {
-		return false, errors.NewFormat(162, fmt.Sprintf("Host %s, return Status [%d]", string(tmpHost), statusCode))
+	if statusCode := revRes.StatusCode(); !h.expectedStatus(statusCode) {
+		return false, errors.NewFormat(162, fmt.Sprintf("Host %s, return Status [%d]", addr, statusCode))
+	}
+	if len(h.bodyContains) > 0 && !bytes.Contains(revRes.Body(), h.bodyContains) {
+		return false, errors.NewFormat(162, fmt.Sprintf("Host %s, body does not contain [%s]", addr, string(h.bodyContains)))
+	}
+	if h.bodyRegex != nil && !h.bodyRegex.Match(revRes.Body()) {
+		return false, errors.NewFormat(162, fmt.Sprintf("Host %s, body does not match [%s]", addr, h.bodyRegex))
+	}
+	return true, nil
+}
+
+func (h *HealthCheck) expectedStatus(statusCode int) bool {
+	if len(h.expectStatus) == 0 {
+		return statusCode >= 200 && statusCode < 400
+	}
+	for _, code := range h.expectStatus {
+		if code == statusCode {
+			return true
+		}
 	}
+	return false
 }
 
-func (r *Table) doHealthCheck() {
+// checkGRPC calls the standard grpc health service, the path is the name of the checked service and `/` or empty
+// checks the whole server. The call is made in plaintext when tlsConfig is nil.
+func (h *HealthCheck) checkGRPC(addr string, tlsConfig *tls.Config) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeoutDuration())
+	defer cancel()
+	security := grpc.WithInsecure()
+	if tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.DialContext(ctx, addr, security, grpc.WithBlock())
+	if err != nil {
+		logger.Error(err)
+		return false, errors.NewFormat(162, err.Error())
+	}
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: strings.Trim(string(h.path), "/"),
+	})
+	if err != nil {
+		logger.Error(err)
+		return false, errors.NewFormat(162, err.Error())
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return false, errors.NewFormat(162, fmt.Sprintf("Host %s, return Status [%s]", addr, resp.Status))
+	}
+	return true, nil
+}
+
+// scheduleHealthCheck starts the checks of the endpoints which are due. Every endpoint is checked on its own
+// interval in its own goroutine, so a hanging endpoint can not delay the others. Results are posted back to the
+// event goroutine with PushWatchEvent, the tables are only modified there.
+func (r *Table) scheduleHealthCheck(now time.Time) {
 	r.endpointTable.Range(func(key EndpointNameString, value *Endpoint) bool {
-		var status Status
-		if value.status == Offline {
-			logger.Infof("EndPoint [%s] OFFLINE, skip health check", value.nameString)
+		state, ok := r.checks[key]
+		if !ok {
+			state = &healthCheckState{}
+			r.checks[key] = state
+		}
+		if state.isRunning() || now.Before(state.next) {
 			return false
 		}
-		resp, err := utils.GetKV(r.cli, value.key(constant.StatusKeyString))
-		if err != nil {
-			logger.Error(err)
-			status = BreakDown
-		} else {
-			for _, kv := range resp.Kvs {
-				if bytes.Equal(kv.Key, []byte(value.key(constant.StatusKeyString))) {
-					statusInt, err := strconv.ParseInt(string(kv.Value), 10, 64)
-					if err != nil {
-						logger.Error(err)
-						status = BreakDown
-					} else {
-						status = Status(statusInt)
-					}
-				} else {
-					status = BreakDown
-				}
-			}
+		if value.healthCheck == nil {
+			state.next = now.Add(defaultHealthCheckInterval)
+			logger.Warnf("EndPoint [%s] has no health check, skipped", value.nameString)
+			return false
+		}
+		if value.status == Draining {
+			state.next = now.Add(value.healthCheck.intervalDuration())
+			logger.Debugf("EndPoint [%s] DRAINING, skip health check", value.nameString)
+			return false
+		}
+		r.startHealthCheck(value, now)
+		return false
+	})
+	for key := range r.checks {
+		if _, ok := r.endpointTable.Load(key); !ok {
+			delete(r.checks, key)
 		}
-		if check, err := value.healthCheck.Check(value.host, value.port); err == nil {
-			if check {
-				if status != Online {
-					_ = r.SetEndpointStatus(value, Online)
+	}
+}
+
+// startHealthCheck checks the endpoint in its own goroutine and schedules its next check. It is also used when the
+// table is loaded and when a node is created or changed, so no check ever blocks the event goroutine. An endpoint
+// already being checked is checked again as soon as the running check is applied.
+func (r *Table) startHealthCheck(ep *Endpoint, now time.Time) {
+	state, ok := r.checks[ep.nameString]
+	if !ok {
+		state = &healthCheckState{}
+		r.checks[ep.nameString] = state
+	}
+	if state.isRunning() {
+		state.next = time.Time{}
+		return
+	}
+	state.next = now.Add(ep.healthCheck.intervalDuration())
+	atomic.StoreInt32(&state.running, 1)
+	// the endpoint may be refreshed by the event goroutine meanwhile, the check works on copies
+	hc := *ep.healthCheck
+	go r.runHealthCheck(ep, state, ep.status, &hc, ep.host, ep.port, ep.scheme, ep.tls, ep.key(constant.StatusKeyString))
+}
+
+// runHealthCheck checks the endpoint, which was in status current when the check started. The result is only posted
+// to the event goroutine when it changes the status of the endpoint.
+func (r *Table) runHealthCheck(ep *Endpoint, state *healthCheckState, current Status, hc *HealthCheck, host []byte,
+	port int, scheme string, opts *upstreamTLS, statusKey string) {
+	var status Status
+	resp, err := utils.GetKV(r.cli, statusKey)
+	if err != nil {
+		logger.Error(err)
+		status = BreakDown
+	} else {
+		for _, kv := range resp.Kvs {
+			if bytes.Equal(kv.Key, []byte(statusKey)) {
+				statusInt, err := strconv.ParseInt(string(kv.Value), 10, 64)
+				if err != nil {
+					logger.Error(err)
+					status = BreakDown
+				} else {
+					status = Status(statusInt)
 				}
 			} else {
-				if status != Offline {
-					_ = r.SetEndpointStatus(value, BreakDown)
-				}
+				status = BreakDown
 			}
-		} else {
-			logger.Error(err.(errors.Error).String())
-			_ = r.SetEndpointStatus(value, BreakDown)
+		}
+	}
+	check, err := hc.checkEndpoint(host, port, scheme, opts)
+	if !check && hc.retry {
+		check, err = hc.checkEndpoint(host, port, scheme, opts)
+	}
+	if err != nil {
+		logger.Error(err.(errors.Error).String())
+	}
+	healthy := err == nil && check
+	if !statusChange(current, status, healthy) {
+		atomic.StoreInt32(&state.running, 0)
+		return
+	}
+	r.PushWatchEvent(WatchMsg{Check: func() bool {
+		return r.applyHealthCheck(ep, status, healthy)
+	}})
+}
+
+// statusChange reports whether a check changes an endpoint in status current, stored is its status in etcd. Failed
+// checks are counted until the endpoint is offline, an offline endpoint stays offline until a check succeeds.
+func statusChange(current, stored Status, healthy bool) bool {
+	if current == Draining || stored == Draining {
+		return false
+	}
+	if healthy {
+		return current != Online || stored != Online
+	}
+	return current != Offline
+}
+
+// applyHealthCheck updates the status of the endpoint and its routers with the result of a check, it reports whether
+// the status of the endpoint changed
+func (r *Table) applyHealthCheck(ep *Endpoint, status Status, healthy bool) bool {
+	if state, ok := r.checks[ep.nameString]; ok {
+		atomic.StoreInt32(&state.running, 0)
+	}
+	if current, ok := r.endpointTable.Load(ep.nameString); !ok || current != ep {
+		// the endpoint has been deleted or replaced during the check
+		return false
+	}
+	if !statusChange(ep.status, status, healthy) {
+		// the node started draining or has been set meanwhile
+		return false
+	}
+	before := ep.status
+	if healthy {
+		_ = r.SetEndpointStatus(ep, Online)
+	} else {
+		_ = r.SetEndpointStatus(ep, BreakDown)
+	}
+	if ep.status == before {
+		// a failed check is only counted
+		return false
+	}
+	// services loaded with their own copy of the endpoint follow its status
+	r.serviceTable.Range(func(key ServiceNameString, value *Service) bool {
+		if value.ep == nil {
+			return false
+		}
+		if ori, ok := value.ep.Load(ep.nameString); ok && ori != ep {
+			ori.setStatus(ep.status)
 		}
 		return false
 	})
+	r.refreshRouterStatus()
+	return true
+}
+
+// refreshRouterStatus sets the status of the routers from the status of the endpoints of their services
+func (r *Table) refreshRouterStatus() {
 	r.routerTable.Range(func(key RouterNameString, value *Router) {
 		confirm, rest := value.service.checkEndpointStatus(Online)
 		if len(confirm) > 0 {
 			if value.status != Online {
 				_, _ = r.SetRouterOnline(value)
 			}
-			if err := value.service.ResetOnlineEndpointRing(confirm); err != nil {
-				logger.Error(err.(errors.Error).String())
-			}
 		} else {
 			for _, i := range rest {
 				if i.status == BreakDown && value.status != BreakDown {
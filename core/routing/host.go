@@ -0,0 +1,43 @@
+package routing
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	wildcardHostPrefix = "*."
+)
+
+// normalizeHost lower-cases the host and strips the port, IPv6 literals keep their brackets
+func normalizeHost(host []byte) string {
+	host = bytes.TrimSpace(host)
+	if idx := bytes.LastIndexByte(host, ':'); idx >= 0 && !bytes.HasSuffix(host, []byte("]")) {
+		host = host[:idx]
+	}
+	return strings.ToLower(string(host))
+}
+
+// hostMatch reports whether host is matched by pattern. Pattern is either an exact host name or a wildcard
+// like `*.example.com`, which matches any sub-domain of example.com but not example.com itself.
+func hostMatch(pattern, host string) bool {
+	if strings.HasPrefix(pattern, wildcardHostPrefix) {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// acceptHost checks the request host against `Server.ListenDomainName`, every host is accepted when the list is
+// empty
+func (r *Table) acceptHost(host string) bool {
+	if len(r.listenDomain) == 0 {
+		return true
+	}
+	for _, pattern := range r.listenDomain {
+		if hostMatch(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,57 @@
 package routing
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type RouteInfo struct {
 	Name        string            `json:"name"`
 	Status      Status            `json:"status"`
+	Host        string            `json:"host"`
+	Match       []string          `json:"match"`
 	FrontendApi string            `json:"frontend_api"`
 	BackendApi  string            `json:"backend_api"`
 	Service     ServiceNameString `json:"service"`
+	// upstream timeout in milliseconds, 0 means using the default of the service
+	Timeout int64 `json:"timeout"`
+	// max attempts of the upstream call, 0 means using the default of the config
+	MaxAttempts        int  `json:"max_attempts"`
+	RetryNonIdempotent bool `json:"retry_non_idempotent"`
+	// the client connection is closed after each response
+	DisableKeepAlive bool `json:"disable_keep_alive"`
+	// the response body is streamed to the client
+	Streaming bool `json:"streaming"`
+	// websocket options, nil when upgrade requests are refused
+	WebSocket *WebSocketInfo `json:"websocket"`
+	// traffic split between services, nil when the router only uses Service
+	Split *SplitInfo `json:"split"`
+	// shadow service receiving a copy of the requests, nil when not mirrored
+	Mirror *MirrorInfo `json:"mirror"`
+}
+
+type SplitInfo struct {
+	Services []SplitServiceInfo `json:"services"`
+	Override string             `json:"override"`
+}
+
+type WebSocketInfo struct {
+	// idle timeout in milliseconds, 0 means the default of 5 minutes
+	IdleTimeout int64 `json:"idle_timeout"`
+	// max connections of the router in this gateway, 0 means unlimited
+	MaxConns int64 `json:"max_conns"`
+	// connections being relayed
+	Conns int64 `json:"conns"`
+}
+
+type MirrorInfo struct {
+	Service ServiceNameString `json:"service"`
+	Percent float64           `json:"percent"`
+}
+
+type SplitServiceInfo struct {
+	Service ServiceNameString `json:"service"`
+	Weight  int               `json:"weight"`
 }
 
 type ServiceInfo struct {
@@ -13,6 +59,25 @@ type ServiceInfo struct {
 	Status           Status               `json:"status"`
 	Endpoint         []EndpointNameString `json:"endpoint"`
 	AcceptHttpMethod []string             `json:"accept_http_method"`
+	// default upstream timeout in milliseconds, 0 means not set
+	Timeout      int64  `json:"timeout"`
+	LoadBalancer string `json:"load_balancer"`
+	HashKey      string `json:"hash_key"`
+	// slow start window in milliseconds, 0 means not set
+	SlowStart int64 `json:"slow_start"`
+	// connection limits of the endpoint pools, 0 means using the `client` config
+	MaxConns            int   `json:"max_conns"`
+	MaxIdleConnDuration int64 `json:"max_idle_conn_duration"`
+}
+
+type PoolInfo struct {
+	MaxConns int `json:"max_conns"`
+	// in milliseconds
+	MaxIdleConnDuration int64 `json:"max_idle_conn_duration"`
+	// requests sent or waiting for a connection
+	Pending int `json:"pending"`
+	// unix time in seconds of the last request, the start time of the gateway when never used
+	LastUse int64 `json:"last_use"`
 }
 
 type HealthCheckInfo struct {
@@ -22,6 +87,14 @@ type HealthCheckInfo struct {
 	Interval  uint8  `json:"interval"`
 	Retry     bool   `json:"retry"`
 	RetryTime uint8  `json:"retry_time"`
+	// prober and assertions, empty when not set
+	Type         string            `json:"type"`
+	Method       string            `json:"method"`
+	Host         string            `json:"host"`
+	Headers      map[string]string `json:"headers"`
+	ExpectStatus []int             `json:"expect_status"`
+	BodyContains string            `json:"body_contains"`
+	BodyRegex    string            `json:"body_regex"`
 }
 
 type EndpointInfo struct {
@@ -30,7 +103,24 @@ type EndpointInfo struct {
 	Host        string           `json:"host"`
 	Port        int              `json:"port"`
 	Status      Status           `json:"status"`
+	Weight      int              `json:"weight"`
+	Inflight    int64            `json:"inflight"`
 	HealthCheck *HealthCheckInfo `json:"health_check"`
+	// taken out of the balancers by the outlier detector until a probe succeeds
+	Ejected bool `json:"ejected"`
+	// upstream connection pool, nil until the endpoint went online
+	Pool *PoolInfo `json:"pool"`
+	// protocol of the node: http, https or h2c
+	Scheme string `json:"scheme"`
+	// tls options of https nodes, nil when not set
+	TLS *TLSInfo `json:"tls"`
+}
+
+type TLSInfo struct {
+	// whether a ca bundle replaces the system roots
+	CA                 bool   `json:"ca"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
 type TableInfo struct {
@@ -55,6 +145,29 @@ func (r *Table) GetTableInfo() *TableInfo {
 			Host:   string(v.host),
 			Port:   v.port,
 			Status: v.status,
+			Weight: v.weight,
+		}
+		t.EndpointTable[k].Scheme = httpScheme
+		if v.scheme != "" {
+			t.EndpointTable[k].Scheme = v.scheme
+		}
+		if v.tls != nil {
+			t.EndpointTable[k].TLS = &TLSInfo{
+				CA:                 v.tls.CA != "",
+				ServerName:         v.tls.ServerName,
+				InsecureSkipVerify: v.tls.InsecureSkipVerify,
+			}
+		}
+		if r.stats != nil {
+			if stats, ok := r.stats.Load(k); ok {
+				t.EndpointTable[k].Inflight = stats.outstanding()
+				t.EndpointTable[k].Ejected = stats.ejected()
+			}
+		}
+		if r.pools != nil {
+			if pool, ok := r.pools.info(k); ok {
+				t.EndpointTable[k].Pool = pool
+			}
 		}
 		if v.healthCheck != nil {
 			t.EndpointTable[k].HealthCheck = &HealthCheckInfo{
@@ -64,6 +177,16 @@ func (r *Table) GetTableInfo() *TableInfo {
 				Interval:  v.healthCheck.interval,
 				Retry:     v.healthCheck.retry,
 				RetryTime: v.healthCheck.retryTime,
+
+				Type:         v.healthCheck.typ,
+				Method:       string(v.healthCheck.method),
+				Host:         string(v.healthCheck.host),
+				Headers:      v.healthCheck.headers,
+				ExpectStatus: v.healthCheck.expectStatus,
+				BodyContains: string(v.healthCheck.bodyContains),
+			}
+			if v.healthCheck.bodyRegex != nil {
+				t.EndpointTable[k].HealthCheck.BodyRegex = v.healthCheck.bodyRegex.String()
 			}
 		}
 		return false
@@ -75,7 +198,13 @@ func (r *Table) GetTableInfo() *TableInfo {
 			Status:           Offline,
 			Endpoint:         []EndpointNameString{},
 			AcceptHttpMethod: []string{},
+			Timeout:          int64(v.timeout / time.Millisecond),
+			LoadBalancer:     v.loadBalancer,
+			HashKey:          v.hashKey,
+			SlowStart:        int64(v.slowStart / time.Millisecond),
 		}
+		t.ServiceTable[k].MaxConns = v.maxConns
+		t.ServiceTable[k].MaxIdleConnDuration = int64(v.maxIdleConnDuration / time.Millisecond)
 		for _, method := range v.acceptHttpMethod {
 			t.ServiceTable[k].AcceptHttpMethod = append(t.ServiceTable[k].AcceptHttpMethod, string(method))
 		}
@@ -93,9 +222,43 @@ func (r *Table) GetTableInfo() *TableInfo {
 		t.RouterTable[k] = &RouteInfo{
 			Name:        string(v.name),
 			Status:      v.status,
+			Host:        string(v.host),
 			FrontendApi: string(v.frontendApi.path),
 			BackendApi:  string(v.backendApi.path),
 			Service:     v.service.nameString,
+			Match:       []string{},
+			Timeout:     int64(v.timeout / time.Millisecond),
+
+			MaxAttempts:        v.maxAttempts,
+			RetryNonIdempotent: v.retryNonIdempotent,
+			DisableKeepAlive:   v.disableKeepAlive,
+			Streaming:          v.streaming,
+		}
+		for _, p := range v.predicates {
+			t.RouterTable[k].Match = append(t.RouterTable[k].Match, p.String())
+		}
+		if v.split != nil {
+			split := &SplitInfo{Services: []SplitServiceInfo{}, Override: v.split.Override}
+			for _, s := range v.split.Services {
+				split.Services = append(split.Services, SplitServiceInfo{
+					Service: ServiceNameString(s.Service),
+					Weight:  s.Weight,
+				})
+			}
+			t.RouterTable[k].Split = split
+		}
+		if v.webSocket != nil {
+			t.RouterTable[k].WebSocket = &WebSocketInfo{
+				IdleTimeout: v.webSocket.IdleTimeout,
+				MaxConns:    v.webSocket.MaxConns,
+				Conns:       atomic.LoadInt64(&v.webSocketConns),
+			}
+		}
+		if v.mirror != nil {
+			t.RouterTable[k].Mirror = &MirrorInfo{
+				Service: ServiceNameString(v.mirror.Service),
+				Percent: v.mirror.Percent,
+			}
 		}
 	})
 
@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/valyala/fasthttp"
+	"strings"
+)
+
+const (
+	methodSeparator = "@"
+)
+
+var (
+	allowSeparator = []byte(", ")
+)
+
+// parseAcceptHttpMethod parses `/Service/Service-x/AcceptHttpMethod`, a json list like `["GET", "POST"]`
+func parseAcceptHttpMethod(value []byte) ([][]byte, error) {
+	var methods []string
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(value, &methods); err != nil {
+		return nil, err
+	}
+	var accept [][]byte
+	for _, m := range methods {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			accept = append(accept, []byte(m))
+		}
+	}
+	return accept, nil
+}
+
+// acceptMethod reports whether the service accepts the http method, an empty list accepts every method
+func (s *serviceEntry) acceptMethod(method []byte) bool {
+	if len(s.methods) == 0 {
+		return true
+	}
+	for _, m := range s.methods {
+		if bytes.Equal(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods collects the methods which would be routed for the path of the request, it is used to answer
+// OPTIONS requests and fill the `Allow` header of 405 responses. OPTIONS itself is always allowed since the gateway
+// answers it, it is the only method left when the services of the path refuse the methods of their routers. Nil is
+// returned when no router matches the path.
+func (s *snapshot) allowedMethods(host string, input [][]byte, req *fasthttp.Request) []byte {
+	var allow [][]byte
+	var options, routed bool
+	candidate := make([][]byte, len(input))
+	copy(candidate, input)
+	for _, method := range s.methods {
+		m := []byte(method)
+		candidate[0] = []byte(method + methodSeparator)
+		route := s.lookup(host, candidate, func(route *routeEntry) bool {
+			if !route.matchPredicates(req) {
+				return false
+			}
+			routed = true
+			return route.service.acceptMethod(m)
+		})
+		if route != nil {
+			allow = append(allow, m)
+			options = options || method == fasthttp.MethodOptions
+		}
+	}
+	if !routed {
+		return nil
+	}
+	if !options {
+		allow = append(allow, []byte(fasthttp.MethodOptions))
+	}
+	return bytes.Join(allow, allowSeparator)
+}
+
+// routeMethod returns the method prefix of a frontend api, e.g. `GET` of `GET@/front/:id`
+func routeMethod(frontend [][]byte) string {
+	if len(frontend) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(string(frontend[0]), methodSeparator)
+}
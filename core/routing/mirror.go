@@ -0,0 +1,133 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/hhjpin/goutils/logger"
+	"github.com/valyala/fasthttp"
+	"math/rand"
+)
+
+const (
+	// header added to mirrored requests, backends may use it to skip side effects
+	mirrorHeader = "X-Gateway-Mirror"
+
+	defaultMaxMirrorInflight = 128
+)
+
+// trafficMirror copies the requests of a router to a shadow service, the shadow responses are discarded. It is
+// stored in etcd as a json object under `/Router/Router-x/Mirror`, e.g. `{"Service": "order-shadow", "Percent": 10}`.
+// Percent defaults to 100.
+type trafficMirror struct {
+	Service string  `json:"Service"`
+	Percent float64 `json:"Percent"`
+}
+
+// mirrorEntry is the read-only copy of a trafficMirror, it is only built when the shadow service has online
+// endpoints
+type mirrorEntry struct {
+	service *serviceEntry
+	percent float64
+}
+
+// mirrorer sends the shadow requests in the background, the number of shadow calls in flight is bounded by
+// `client.Mirror.MaxInflight` and copies exceeding it are dropped, a slow shadow service never slows down nor
+// piles up goroutines in the gateway
+type mirrorer struct {
+	slots chan struct{}
+	// shadow calls are reported as well, the mirror may take the probe of a half-open endpoint
+	outlier *outlierDetector
+}
+
+func parseTrafficMirror(value []byte) (*trafficMirror, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	mirror := &trafficMirror{Percent: 100}
+	if err := json.Unmarshal(value, mirror); err != nil {
+		return nil, err
+	}
+	if mirror.Service == "" {
+		return nil, errors.NewFormat(200, "traffic mirror lack of service name")
+	}
+	if mirror.Percent < 0 || mirror.Percent > 100 {
+		return nil, errors.NewFormat(200, fmt.Sprintf("invalid traffic mirror percent: %v", mirror.Percent))
+	}
+	return mirror, nil
+}
+
+func newMirrorEntry(mirror *trafficMirror, resolve func(name string) *serviceEntry) *mirrorEntry {
+	if mirror == nil || mirror.Percent <= 0 {
+		return nil
+	}
+	svr := resolve(mirror.Service)
+	if svr == nil || len(svr.endpoints) == 0 {
+		return nil
+	}
+	return &mirrorEntry{service: svr, percent: mirror.Percent}
+}
+
+// sample reports whether the current request is mirrored
+func (m *mirrorEntry) sample() bool {
+	return m.percent >= 100 || rand.Float64()*100 < m.percent
+}
+
+func newMirrorer(outlier *outlierDetector) *mirrorer {
+	inflight := conf.Conf.Client.Mirror.MaxInflight
+	if inflight <= 0 {
+		inflight = defaultMaxMirrorInflight
+	}
+	return &mirrorer{slots: make(chan struct{}, inflight), outlier: outlier}
+}
+
+// send copies the upstream request to the mirror of the route if it is sampled. `uri` is the upstream uri without
+// host, the request is copied before returning so the caller may reuse both.
+func (m *mirrorer) send(ctx *fasthttp.RequestCtx, target *TargetServer, req *fasthttp.Request, uri *fasthttp.URI) {
+	if target.route == nil || target.route.mirror == nil || !target.route.mirror.sample() {
+		return
+	}
+	// the slot is taken first, picking a half-open endpoint claims its probe which is only given back by the report
+	// of the call
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		logger.Debugf("too many mirrored requests in flight, dropped: %s", string(uri.Path()))
+		return
+	}
+	ep := target.route.mirror.service.pick(ctx, nil)
+	if ep == nil {
+		<-m.slots
+		return
+	}
+	ep.stats.acquire()
+
+	shadow := fasthttp.AcquireRequest()
+	req.CopyTo(shadow)
+	shadowUri := fasthttp.AcquireURI()
+	uri.CopyTo(shadowUri)
+	shadowUri.SetScheme(ep.uriScheme())
+	shadowUri.SetHostBytes(ep.addr)
+	shadow.SetRequestURIBytes(shadowUri.FullURI())
+	fasthttp.ReleaseURI(shadowUri)
+	shadow.Header.Set(mirrorHeader, string(target.route.name))
+
+	timeout := target.timeout
+	go func() {
+		res := fasthttp.AcquireResponse()
+		defer func() {
+			fasthttp.ReleaseRequest(shadow)
+			fasthttp.ReleaseResponse(res)
+			<-m.slots
+		}()
+		err := ep.doTimeout(shadow, res, timeout)
+		ep.stats.release()
+		if m.outlier != nil {
+			m.outlier.report(ep, err, res.StatusCode())
+		}
+		if err != nil {
+			logger.Debugf("mirrored request to %s failed: %s", string(ep.addr), err)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package routing
+
+import (
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"github.com/hhjpin/goutils/logger"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultFailureRate         = 0.5
+	defaultMinRequests         = 20
+	defaultOutlierInterval     = 10 * time.Second
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 300 * time.Second
+)
+
+// outlierDetector ejects endpoints failing on the proxy path without waiting for the next health check, it is
+// configured by `client.Outlier` of the config file. A call fails on a connection error, a timeout or a 5xx status.
+// An endpoint is ejected after `ConsecutiveFailures` failures in a row, or when at least `FailureRate` of its calls
+// failed within `Interval` with at least `MinRequests` calls. After the ejection time one probe request is let
+// through (half-open), its success brings the endpoint back, its failure ejects it again for twice as long.
+type outlierDetector struct {
+	consecutiveFailures int64
+	failureRate         float64
+	minRequests         int64
+	interval            int64
+	baseEjectionTime    int64
+	maxEjectionTime     int64
+}
+
+func newOutlierDetector() *outlierDetector {
+	cfg := conf.Conf.Client.Outlier
+	d := &outlierDetector{
+		consecutiveFailures: int64(cfg.ConsecutiveFailures),
+		failureRate:         cfg.FailureRate,
+		minRequests:         int64(cfg.MinRequests),
+		interval:            int64(time.Duration(cfg.Interval) * time.Second),
+		baseEjectionTime:    int64(time.Duration(cfg.BaseEjectionTime) * time.Second),
+		maxEjectionTime:     int64(time.Duration(cfg.MaxEjectionTime) * time.Second),
+	}
+	if d.consecutiveFailures <= 0 {
+		d.consecutiveFailures = defaultConsecutiveFailures
+	}
+	if d.failureRate <= 0 {
+		d.failureRate = defaultFailureRate
+	}
+	if d.minRequests <= 0 {
+		d.minRequests = defaultMinRequests
+	}
+	if d.interval <= 0 {
+		d.interval = int64(defaultOutlierInterval)
+	}
+	if d.baseEjectionTime <= 0 {
+		d.baseEjectionTime = int64(defaultBaseEjectionTime)
+	}
+	if d.maxEjectionTime < d.baseEjectionTime {
+		d.maxEjectionTime = int64(defaultMaxEjectionTime)
+		if d.maxEjectionTime < d.baseEjectionTime {
+			d.maxEjectionTime = d.baseEjectionTime
+		}
+	}
+	return d
+}
+
+// report records the result of an upstream call of the endpoint
+func (d *outlierDetector) report(ep *endpointEntry, err error, status int) {
+	d.record(ep.stats, err != nil || status >= 500, time.Now().UnixNano(), string(ep.name))
+}
+
+func (d *outlierDetector) record(s *endpointStats, failed bool, now int64, name string) {
+	if until := atomic.LoadInt64(&s.ejectedUntil); until != 0 {
+		if now < until || atomic.LoadInt32(&s.probing) == 0 {
+			// calls started before the ejection, they say nothing about the current state
+			return
+		}
+		// result of the half-open probe
+		if failed {
+			d.eject(s, now, name)
+		} else {
+			s.restore(now)
+			logger.Infof("endpoint %s is back after a successful probe", name)
+		}
+		atomic.StoreInt32(&s.probing, 0)
+		return
+	}
+
+	start := atomic.LoadInt64(&s.windowStart)
+	if now-start >= d.interval && atomic.CompareAndSwapInt64(&s.windowStart, start, now) {
+		atomic.StoreInt64(&s.requests, 0)
+		atomic.StoreInt64(&s.failures, 0)
+	}
+	requests := atomic.AddInt64(&s.requests, 1)
+	if !failed {
+		atomic.StoreInt64(&s.consecutive, 0)
+		return
+	}
+	failures := atomic.AddInt64(&s.failures, 1)
+	consecutive := atomic.AddInt64(&s.consecutive, 1)
+	if consecutive >= d.consecutiveFailures ||
+		(requests >= d.minRequests && float64(failures) >= d.failureRate*float64(requests)) {
+		d.eject(s, now, name)
+	}
+}
+
+// eject takes the endpoint out of the balancers, every ejection in a row doubles the ejection time
+func (d *outlierDetector) eject(s *endpointStats, now int64, name string) {
+	ejections := atomic.AddInt64(&s.ejections, 1)
+	backoff := d.baseEjectionTime
+	for i := int64(1); i < ejections && backoff < d.maxEjectionTime; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxEjectionTime {
+		backoff = d.maxEjectionTime
+	}
+	atomic.StoreInt64(&s.ejectedUntil, now+backoff)
+	logger.Warnf("endpoint %s ejected for %s after failed upstream calls", name, time.Duration(backoff))
+}
+
+// restore brings an ejected endpoint back and clears its counters
+func (s *endpointStats) restore(now int64) {
+	atomic.StoreInt64(&s.consecutive, 0)
+	atomic.StoreInt64(&s.requests, 0)
+	atomic.StoreInt64(&s.failures, 0)
+	atomic.StoreInt64(&s.windowStart, now)
+	atomic.StoreInt64(&s.ejections, 0)
+	atomic.StoreInt64(&s.ejectedUntil, 0)
+}
+
+// available reports whether the endpoint may be picked: it is not ejected, or its ejection time is over and no
+// probe is in flight
+func (s *endpointStats) available(now int64) bool {
+	if s == nil {
+		return true
+	}
+	until := atomic.LoadInt64(&s.ejectedUntil)
+	return until == 0 || (now >= until && atomic.LoadInt32(&s.probing) == 0)
+}
+
+// claim is called for the picked endpoint, it takes the probe slot of a half-open endpoint. False is returned when
+// another request took it first.
+func (s *endpointStats) claim(now int64) bool {
+	if s == nil {
+		return true
+	}
+	until := atomic.LoadInt64(&s.ejectedUntil)
+	if until == 0 {
+		return true
+	}
+	return now >= until && atomic.CompareAndSwapInt32(&s.probing, 0, 1)
+}
+
+// unclaim gives back the probe slot taken by claim when the picked endpoint is not called after all, e.g. the
+// request was refused by the gateway. The probe is left to the next request.
+func (s *endpointStats) unclaim() {
+	if s != nil && atomic.LoadInt64(&s.ejectedUntil) != 0 {
+		atomic.StoreInt32(&s.probing, 0)
+	}
+}
+
+func (s *endpointStats) ejected() bool {
+	return atomic.LoadInt64(&s.ejectedUntil) != 0
+}
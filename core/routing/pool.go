@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// poolOptions are the connection limits of an endpoint pool, `client.MaxConnsPerHost` and
+// `client.MaxIdleConnDuration` of the config file unless the service overrides them
+type poolOptions struct {
+	maxConns            int
+	maxIdleConnDuration time.Duration
+}
+
+// connPool keeps the upstream connections of an endpoint
+type connPool struct {
+	client *fasthttp.HostClient
+	opts   poolOptions
+	// tls options of https nodes, see upstreamTLS
+	tls string
+}
+
+// connPoolMap is the registry of the endpoint pools, like endpointStats they are shared by all snapshots. Pools are
+// created by publish() and dropped when their endpoint leaves the table. The idle connections of a replaced or
+// dropped pool are closed at once, the ones of the requests in flight by its idle cleaner once they complete.
+type connPoolMap struct {
+	sync.RWMutex
+	name     string
+	defaults poolOptions
+	internal map[EndpointNameString]*connPool
+}
+
+func newConnPoolMap() *connPoolMap {
+	cfg := conf.Conf.Client
+	m := &connPoolMap{
+		name: cfg.Name,
+		defaults: poolOptions{
+			maxConns:            cfg.MaxConnsPerHost,
+			maxIdleConnDuration: time.Duration(cfg.MaxIdleConnDuration) * time.Second,
+		},
+		internal: make(map[EndpointNameString]*connPool),
+	}
+	if m.defaults.maxConns <= 0 {
+		m.defaults.maxConns = fasthttp.DefaultMaxConnsPerHost
+	}
+	if m.defaults.maxIdleConnDuration <= 0 {
+		m.defaults.maxIdleConnDuration = fasthttp.DefaultMaxIdleConnDuration
+	}
+	return m
+}
+
+// parseMaxConns parses the `MaxConns` attribute of services
+func parseMaxConns(value []byte) (int, error) {
+	conns, err := strconv.ParseUint(string(value), 10, 31)
+	if err != nil || conns == 0 {
+		return 0, errors.NewFormat(200, fmt.Sprintf("invalid max conns: %s", string(value)))
+	}
+	return int(conns), nil
+}
+
+// options returns the limits of the endpoints of the service
+func (m *connPoolMap) options(s *Service) poolOptions {
+	opts := m.defaults
+	if s.maxConns > 0 {
+		opts.maxConns = s.maxConns
+	}
+	if s.maxIdleConnDuration > 0 {
+		opts.maxIdleConnDuration = s.maxIdleConnDuration
+	}
+	return opts
+}
+
+func (m *connPoolMap) Load(key EndpointNameString) (value *connPool, ok bool) {
+	m.RLock()
+	value, ok = m.internal[key]
+	m.RUnlock()
+	return value, ok
+}
+
+// attach gives every endpoint of the service entry the client of its pool. A pool is replaced when the endpoint
+// moved to another address, changed its scheme or tls options, or its idle duration changed, a new connection
+// limit is applied in place. Nodes are
+// expected to belong to a single service, the limits of the last attached service win otherwise.
+func (m *connPoolMap) attach(s *Service, entry *serviceEntry) {
+	opts := m.options(s)
+	m.Lock()
+	defer m.Unlock()
+	for _, ep := range entry.endpoints {
+		pool, ok := m.internal[ep.name]
+		if !ok || pool.client.Addr != string(ep.addr) || pool.client.IsTLS != (ep.scheme == httpsScheme) ||
+			pool.tls != ep.tls.String() || pool.opts.maxIdleConnDuration != opts.maxIdleConnDuration {
+			if ok {
+				pool.client.CloseIdleConnections()
+			}
+			pool = &connPool{
+				client: &fasthttp.HostClient{
+					Addr:                string(ep.addr),
+					Name:                m.name,
+					MaxConns:            opts.maxConns,
+					MaxIdleConnDuration: opts.maxIdleConnDuration,
+					IsTLS:               ep.scheme == httpsScheme,
+					TLSConfig:           ep.tls.tlsConfig(),
+				},
+				opts: opts,
+				tls:  ep.tls.String(),
+			}
+			m.internal[ep.name] = pool
+		} else if pool.opts.maxConns != opts.maxConns {
+			pool.client.SetMaxConns(opts.maxConns)
+			pool.opts.maxConns = opts.maxConns
+		}
+		ep.client = pool.client
+	}
+}
+
+// Retain removes the pools of the endpoints for which keep returns false
+func (m *connPoolMap) Retain(keep func(key EndpointNameString) bool) {
+	m.Lock()
+	for k, pool := range m.internal {
+		if !keep(k) {
+			pool.client.CloseIdleConnections()
+			delete(m.internal, k)
+		}
+	}
+	m.Unlock()
+}
+
+// info returns the state of the pool of the endpoint
+func (m *connPoolMap) info(key EndpointNameString) (*PoolInfo, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	p, ok := m.internal[key]
+	if !ok {
+		return nil, false
+	}
+	return &PoolInfo{
+		MaxConns:            p.opts.maxConns,
+		MaxIdleConnDuration: int64(p.opts.maxIdleConnDuration / time.Millisecond),
+		Pending:             p.client.PendingRequests(),
+		LastUse:             p.client.LastUseTime().Unix(),
+	}, true
+}
+
+// doTimeout calls the endpoint through its pool. Entries built without a pool use the default client of fasthttp,
+// h2c nodes are called by the http/2 client which keeps its own connections.
+func (e *endpointEntry) doTimeout(req *fasthttp.Request, res *fasthttp.Response, timeout time.Duration) error {
+	if e.scheme == h2cScheme {
+		return doH2C(string(e.addr), req, res, timeout)
+	}
+	if e.client == nil {
+		return fasthttp.DoTimeout(req, res, timeout)
+	}
+	return e.client.DoTimeout(req, res, timeout)
+}
@@ -0,0 +1,78 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"strings"
+)
+
+const (
+	headerPredicate = "header"
+	queryPredicate  = "query"
+	cookiePredicate = "cookie"
+)
+
+// predicate is an additional match condition of a router besides method, host and path. It is stored in etcd as
+// a json list under `/Router/Router-x/Match`, e.g. `[{"Type": "header", "Name": "X-Api-Version", "Value": "2"}]`.
+// An empty value only requires the header, query parameter or cookie to be present.
+type predicate struct {
+	Type  string `json:"Type"`
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+func parsePredicates(value []byte) ([]*predicate, error) {
+	var predicates []*predicate
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(value, &predicates); err != nil {
+		return nil, err
+	}
+	for _, p := range predicates {
+		p.Type = strings.ToLower(p.Type)
+		switch p.Type {
+		case headerPredicate, queryPredicate, cookiePredicate:
+		default:
+			return nil, errors.NewFormat(200, fmt.Sprintf("unsupported match predicate type: %s", p.Type))
+		}
+		if p.Name == "" {
+			return nil, errors.NewFormat(200, "match predicate lack of name")
+		}
+	}
+	return predicates, nil
+}
+
+func (p *predicate) match(req *fasthttp.Request) bool {
+	var actual []byte
+	switch p.Type {
+	case headerPredicate:
+		actual = req.Header.Peek(p.Name)
+	case queryPredicate:
+		actual = req.URI().QueryArgs().Peek(p.Name)
+	case cookiePredicate:
+		actual = req.Header.Cookie(p.Name)
+	default:
+		return false
+	}
+	if actual == nil {
+		return false
+	}
+	return p.Value == "" || p.Value == string(actual)
+}
+
+func (p *predicate) String() string {
+	return fmt.Sprintf("%s:%s=%s", p.Type, p.Name, p.Value)
+}
+
+// matchPredicates reports whether the request satisfies every predicate of the route
+func (e *routeEntry) matchPredicates(req *fasthttp.Request) bool {
+	for _, p := range e.predicates {
+		if !p.match(req) {
+			return false
+		}
+	}
+	return true
+}
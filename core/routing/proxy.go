@@ -12,55 +12,55 @@ import (
 
 const (
 	middlewareTimeoutLimit = 1
+
+	// RFC 7540, 9.1.2, not defined by fasthttp
+	statusMisdirectedRequest = 421
 )
 
 func MainRequestHandlerWrapper(table *Table, middle ...middleware.Middleware) fasthttp.RequestHandler {
-	return fasthttp.TimeoutHandler(
-		func(ctx *fasthttp.RequestCtx) {
-			start := time.Now()
-			ctx.SetUserValue("Table", table)
-			if len(middle) > 0 {
-				errChan := make(chan error, len(middle))
-				for _, m := range middle {
-					go m.Work(ctx, errChan)
-				}
-				timer := time.NewTimer(middlewareTimeoutLimit * time.Second)
-				for i := 0; i < len(middle); i++ {
-					timer.Reset(1 * time.Second)
-					select {
-					case <-timer.C:
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		defer finishRequestBody(ctx)
+		ctx.SetUserValue("Table", table)
+		if len(middle) > 0 {
+			errChan := make(chan error, len(middle))
+			for _, m := range middle {
+				go m.Work(ctx, errChan)
+			}
+			timer := time.NewTimer(middlewareTimeoutLimit * time.Second)
+			for i := 0; i < len(middle); i++ {
+				timer.Reset(1 * time.Second)
+				select {
+				case <-timer.C:
+					ctx.Response.SetStatusCode(fasthttp.StatusOK)
+					ctx.Response.Header.Set("Server", "Api Gateway")
+					ctx.Response.Header.SetContentTypeBytes(constant.StrApplicationJson)
+					body := errors.New(5).MarshalEmptyData()
+					ctx.Response.SetBody(body)
+					go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
+					return
+				case e := <-errChan:
+					if e != nil {
 						ctx.Response.SetStatusCode(fasthttp.StatusOK)
 						ctx.Response.Header.Set("Server", "Api Gateway")
 						ctx.Response.Header.SetContentTypeBytes(constant.StrApplicationJson)
-						body := errors.New(5).MarshalEmptyData()
-						ctx.Response.SetBody(body)
-						go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
-						return
-					case e := <-errChan:
-						if e != nil {
-							ctx.Response.SetStatusCode(fasthttp.StatusOK)
-							ctx.Response.Header.Set("Server", "Api Gateway")
-							ctx.Response.Header.SetContentTypeBytes(constant.StrApplicationJson)
-							if err, ok := e.(errors.Error); ok {
-								ctx.Response.SetBody(err.MarshalEmptyData())
-								go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
-								return
-							} else {
-								ctx.Response.SetBody(errors.New(1).MarshalEmptyData())
-								go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
-								return
-							}
+						if err, ok := e.(errors.Error); ok {
+							ctx.Response.SetBody(err.MarshalEmptyData())
+							go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
+							return
+						} else {
+							ctx.Response.SetBody(errors.New(1).MarshalEmptyData())
+							go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
+							return
 						}
 					}
 				}
 			}
-			ReverseProxyHandler(ctx)
-			go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
-			return
-		},
-		time.Second*60,
-		string(errors.New(5).MarshalEmptyData()),
-	)
+		}
+		ReverseProxyHandler(ctx)
+		go middleware.Logger(ctx.Response.StatusCode(), string(ctx.Request.URI().Path()), string(ctx.Request.Header.Method()), ctx.RemoteIP().String(), start)
+		return
+	}
 }
 
 func ReverseProxyHandler(ctx *fasthttp.RequestCtx) {
@@ -69,7 +69,12 @@ func ReverseProxyHandler(ctx *fasthttp.RequestCtx) {
 	revRes := fasthttp.AcquireResponse()
 
 	defer fasthttp.ReleaseRequest(revReq)
-	defer fasthttp.ReleaseResponse(revRes)
+	defer func() {
+		// a streamed response is released once its body is sent
+		if revRes != nil {
+			fasthttp.ReleaseResponse(revRes)
+		}
+	}()
 	defer fasthttp.ReleaseURI(revReqUri)
 
 	//defer func() {
@@ -122,12 +127,23 @@ func ReverseProxyHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	target, err := rt.Select(ctx.Path(), ctx.Method())
+	target, err := rt.Select(ctx)
 	if err != nil {
 		logger.Error(err)
 		if e, ok := err.(errors.Error); ok {
 			if e.ErrCode == 142 {
 				ctx.Error(string(e.MarshalEmptyData()), fasthttp.StatusNotFound)
+			} else if e.ErrCode == 145 {
+				ctx.Error(string(e.MarshalEmptyData()), statusMisdirectedRequest)
+			} else if e.ErrCode == 146 {
+				if ctx.IsOptions() {
+					// no router is registered for OPTIONS, answer it with the methods of the path
+					ctx.Response.Reset()
+					ctx.SetStatusCode(fasthttp.StatusNoContent)
+				} else {
+					ctx.Error(string(e.MarshalEmptyData()), fasthttp.StatusMethodNotAllowed)
+				}
+				ctx.Response.Header.SetBytesV("Allow", target.allow)
 			} else {
 				ctx.Error(string(e.MarshalEmptyData()), fasthttp.StatusInternalServerError)
 			}
@@ -137,8 +153,27 @@ func ReverseProxyHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if target.route != nil && target.route.webSocket != nil && isWebSocketUpgrade(ctx) {
+		rt.webSocket.serve(ctx, &target)
+		return
+	}
+	if streamed(ctx, &target) {
+		rt.stream.serve(ctx, &target)
+		return
+	}
+	// the slot of a streamed response is given back once its body is sent
+	streaming := false
+	defer func() {
+		if !streaming {
+			target.release()
+		}
+	}()
+
+	reqHop := newHopFilter(ctx.Request.Header.Peek("Connection"))
 	ctx.Request.Header.VisitAll(func(key, value []byte) {
-		if bytes.Equal(key, constant.StrHost) {
+		if reqHop.isHop(key) {
+			// pass
+		} else if bytes.Equal(key, constant.StrHost) {
 			revReq.Header.AddBytesV("X-Forwarded-Host", value)
 		} else if bytes.Equal(key, constant.StrContentType) {
 			revReq.Header.SetContentTypeBytes(value)
@@ -149,34 +184,91 @@ func ReverseProxyHandler(ctx *fasthttp.RequestCtx) {
 		}
 	})
 
-	revReqUri.SetHostBytes(target.host)
 	revReqUri.SetPathBytes(target.uri)
-	revReqUri.SetScheme("http")
 
 	if queryString := ctx.QueryArgs().QueryString(); len(queryString) > 0 {
 		revReqUri.SetQueryStringBytes(queryString)
 	}
-	revReq.SetRequestURIBytes(revReqUri.FullURI())
 
-	if body := ctx.Request.Body(); len(body) > 0 {
+	body, err := bufferedRequestBody(ctx)
+	if err != nil {
+		target.endpoint().stats.unclaim()
+		ctx.SetConnectionClose()
+		if err == fasthttp.ErrBodyTooLarge {
+			ctx.Error("Request Entity Too Large", fasthttp.StatusRequestEntityTooLarge)
+		} else {
+			logger.Warnf("read request body failed: %s", err)
+			ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		}
+		return
+	}
+	if len(body) > 0 {
 		revReq.SetBody(body)
 	}
 	revReq.Header.SetMethodBytes(ctx.Request.Header.Method())
-	err = fasthttp.Do(revReq, revRes)
-	if err != nil {
+	rt.mirror.send(ctx, &target, revReq, revReqUri)
+
+	rt.retry.budget.deposit()
+	for attempt := 1; ; attempt++ {
+		ep := target.endpoint()
+		// the call returns once the header is read, chunked bodies are read while they are sent to the client
+		revRes.StreamBody = true
+		revReqUri.SetScheme(ep.uriScheme())
+		revReqUri.SetHostBytes(target.host)
+		revReq.SetRequestURIBytes(revReqUri.FullURI())
+		err = ep.doTimeout(revReq, revRes, target.timeout)
+		rt.outlier.report(ep, err, revRes.StatusCode())
+		if !rt.retry.shouldRetry(&target, attempt, ctx.Method(), err, revRes.StatusCode()) {
+			break
+		}
+		prev := target.host
+		if !target.retarget(ctx) {
+			break
+		}
+		closeResponseStream(revRes)
+		logger.Warnf("retry upstream call on %s, attempt %d failed on %s, err: %v, status: %d",
+			string(target.host), attempt, string(prev), err, revRes.StatusCode())
+	}
+	if err == fasthttp.ErrTimeout {
+		logger.Warnf("upstream timeout after %s: %s%s", target.timeout, string(target.host), string(target.uri))
+		ctx.Error("Gateway Timeout", fasthttp.StatusGatewayTimeout)
+		return
+	} else if err == fasthttp.ErrNoFreeConns {
+		logger.Warnf("upstream connection pool exhausted: %s", string(target.host))
+		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		logger.Error(err)
 		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
 		return
 	}
+	// the client connection is kept alive unless the server or the router disables it, the connection headers of
+	// the backend only apply to the upstream connection
+	resHop := newHopFilter(revRes.Header.Peek("Connection"))
 	revRes.Header.VisitAll(func(key, value []byte) {
-		if bytes.Equal(key, constant.StrHost) {
+		if bytes.Equal(key, constant.StrHost) || resHop.isHop(key) {
 			// pass
 		} else {
 			ctx.Response.Header.SetBytesKV(key, value)
 		}
 	})
-	ctx.Response.SetConnectionClose()
+	if target.route != nil && target.route.disableKeepAlive {
+		ctx.SetConnectionClose()
+	}
 	ctx.Response.SetStatusCode(revRes.StatusCode())
 	ctx.Response.Header.SetContentTypeBytes(revRes.Header.ContentType())
+	if streamedResponse(revRes) {
+		ep, res := target.endpoint(), revRes
+		streaming, revRes = true, nil
+		ctx.Response.ImmediateHeaderFlush = true
+		ctx.SetBodyStream(&streamBody{ReadCloser: &responseStream{res: res}, done: func() {
+			fasthttp.ReleaseResponse(res)
+			ep.stats.release()
+		}}, -1)
+		return
+	}
+	if target.route != nil {
+		warnUnstreamed(&target, revRes)
+	}
 	ctx.SetBody(revRes.Body())
 }
@@ -0,0 +1,190 @@
+package routing
+
+import (
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/time/rate"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	defaultRetryBudgetRatio    = 0.2
+	defaultMinRetriesPerSecond = 10
+
+	// budget tokens are fixed-point numbers, one retry costs retryTokenScale
+	retryTokenScale = 1000
+	// unused budget is capped, a long quiet period must not allow a burst of retries
+	maxRetryTokens = 100 * retryTokenScale
+)
+
+// retryPolicy decides whether a failed upstream call is tried again on the next endpoint, it is configured by
+// `client.Retry` of the config file
+type retryPolicy struct {
+	// default max attempts of a router, including the first one
+	maxAttempts int
+	// upstream status codes to retry, connection errors are always retried
+	retryOn map[int]bool
+	budget  *retryBudget
+}
+
+// retryBudget limits retries to a ratio of the proxied requests plus a small fixed rate. Every request deposits
+// `ratio` tokens, every retry withdraws one.
+type retryBudget struct {
+	// must be the first field to keep 64-bit alignment for atomic operations
+	tokens int64
+
+	ratio int64
+	min   *rate.Limiter
+}
+
+func newRetryPolicy() *retryPolicy {
+	cfg := conf.Conf.Client.Retry
+	p := &retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		retryOn:     make(map[int]bool),
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = 1
+	}
+	for _, code := range cfg.RetryOn {
+		p.retryOn[code] = true
+	}
+	ratio := cfg.BudgetRatio
+	if ratio <= 0 {
+		ratio = defaultRetryBudgetRatio
+	}
+	min := cfg.MinRetriesPerSecond
+	if min <= 0 {
+		min = defaultMinRetriesPerSecond
+	}
+	p.budget = newRetryBudget(ratio, min)
+	return p
+}
+
+func newRetryBudget(ratio float64, minPerSecond int) *retryBudget {
+	return &retryBudget{
+		ratio: int64(ratio * retryTokenScale),
+		min:   rate.NewLimiter(rate.Limit(minPerSecond), minPerSecond),
+	}
+}
+
+func (b *retryBudget) deposit() {
+	for {
+		cur := atomic.LoadInt64(&b.tokens)
+		if cur >= maxRetryTokens {
+			return
+		}
+		next := cur + b.ratio
+		if next > maxRetryTokens {
+			next = maxRetryTokens
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, cur, next) {
+			return
+		}
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	if b.min.Allow() {
+		return true
+	}
+	for {
+		cur := atomic.LoadInt64(&b.tokens)
+		if cur < retryTokenScale {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, cur, cur-retryTokenScale) {
+			return true
+		}
+	}
+}
+
+// shouldRetry reports whether the `attempt`-th call of the target may be retried. Timeouts are never retried, the
+// upstream may still be working on the request.
+func (p *retryPolicy) shouldRetry(target *TargetServer, attempt int, method []byte, err error, status int) bool {
+	if target.route == nil {
+		return false
+	}
+	maxAttempts := target.route.maxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = p.maxAttempts
+	}
+	if attempt >= maxAttempts {
+		return false
+	}
+	if err == fasthttp.ErrTimeout {
+		return false
+	} else if err == nil && !p.retryOn[status] {
+		return false
+	}
+	if !target.route.retryNonIdempotent && !isIdempotent(method) {
+		return false
+	}
+	return p.budget.withdraw()
+}
+
+// isIdempotent reports whether the method is idempotent as defined by RFC 7231, 4.2.2
+func isIdempotent(method []byte) bool {
+	switch string(method) {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodOptions, fasthttp.MethodTrace,
+		fasthttp.MethodPut, fasthttp.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// parseMaxAttempts parses the `MaxAttempts` attribute of routers, it includes the first attempt
+func parseMaxAttempts(value []byte) (int, error) {
+	attempts, err := strconv.ParseUint(string(value), 10, 8)
+	if err != nil || attempts == 0 {
+		return 0, errors.NewFormat(200, fmt.Sprintf("invalid max attempts: %s", string(value)))
+	}
+	return int(attempts), nil
+}
+
+// retarget moves the target to another endpoint of its service, endpoints already tried are skipped unless every
+// endpoint has been tried. The in-flight slot moves along with the target.
+func (t *TargetServer) retarget(ctx *fasthttp.RequestCtx) bool {
+	if t.service == nil {
+		return false
+	}
+	ep := t.service.pick(ctx, t.hasTried)
+	if ep == nil {
+		ep = t.service.pick(ctx, nil)
+	}
+	if ep == nil {
+		return false
+	}
+	ep.stats.acquire()
+	t.release()
+	t.host = ep.addr
+	t.tried = append(t.tried, ep)
+	return true
+}
+
+// release gives back the in-flight slot of the endpoint of the current attempt
+func (t *TargetServer) release() {
+	if ep := t.endpoint(); ep != nil {
+		ep.stats.release()
+	}
+}
+
+// endpoint returns the endpoint of the current attempt
+func (t *TargetServer) endpoint() *endpointEntry {
+	if len(t.tried) == 0 {
+		return nil
+	}
+	return t.tried[len(t.tried)-1]
+}
+
+func (t *TargetServer) hasTried(ep *endpointEntry) bool {
+	for _, tried := range t.tried {
+		if tried == ep {
+			return true
+		}
+	}
+	return false
+}
@@ -17,7 +17,6 @@ package routing
 
 import (
 	"bytes"
-	"container/ring"
 	"fmt"
 	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
 	"git.henghajiang.com/backend/api_gateway_v2/core/utils"
@@ -25,14 +24,20 @@ import (
 	"github.com/coreos/etcd/clientv3"
 	"github.com/hhjpin/goutils/errors"
 	"github.com/hhjpin/goutils/logger"
+	"github.com/valyala/fasthttp"
 	"golang.org/x/time/rate"
+	"regexp"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	Offline Status = iota
 	Online
 	BreakDown
+	// set by the node itself before shutting down, the endpoint receives no new request and is not health checked
+	Draining
 )
 
 var (
@@ -52,7 +57,8 @@ type RouterNameString string
 type Table struct {
 	Version string
 
-	// frontend-api/router mapping table
+	// registered routers keyed by router name, several routers may share a frontend-api under different hosts or
+	// match predicates
 	table ApiRouterTableMap
 	// online frontend-api/router mapping table
 	onlineTable OnlineApiRouterTableMap
@@ -65,6 +71,32 @@ type Table struct {
 
 	// events
 	events *Events
+	// health check schedule of the endpoints, only used by the event goroutine
+	checks map[EndpointNameString]*healthCheckState
+	// in-flight reports of the draining endpoints, fed by the event goroutine
+	drain *drainReporter
+
+	// current *snapshot read by the request path, see publish()
+	current atomic.Value
+	// hosts accepted by the gateway, from `Server.ListenDomainName`
+	listenDomain []string
+	// retry policy of upstream calls, from `client.Retry`
+	retry *retryPolicy
+	// runtime stats of the endpoints shared by all snapshots
+	stats *endpointStatsMap
+	// round-robin state of the services shared by all snapshots
+	balances *serviceBalanceMap
+	// upstream connection pools of the endpoints shared by all snapshots, from `client.MaxConnsPerHost` and
+	// `client.MaxIdleConnDuration`
+	pools *connPoolMap
+	// passive failure detection of the endpoints, from `client.Outlier`
+	outlier *outlierDetector
+	// sender of mirrored requests
+	mirror *mirrorer
+	// upstream client of the streaming routers
+	stream *streamer
+	// relay of the websocket routers
+	webSocket *webSocketProxy
 
 	cli *clientv3.Client
 }
@@ -76,6 +108,8 @@ type FrontendApi struct {
 	pathString FrontendApiString
 	// []byte pattern
 	pattern [][]byte
+	// compiled constraints of the path parameters, indexed like pattern, nil for unconstrained segments
+	constraints []*regexp.Regexp
 }
 
 type BackendApi struct {
@@ -92,7 +126,13 @@ type Endpoint struct {
 
 	host   []byte
 	port   int
-	status Status // 0 -> offline, 1 -> online, 2 -> breakdown
+	status Status // 0 -> offline, 1 -> online, 2 -> breakdown, 3 -> draining
+	// share of traffic relative to the other endpoints of the service, 0 receives no traffic
+	weight int
+	// optional protocol of the node, `https` or `h2c`, empty means http
+	scheme string
+	// optional tls options of https nodes
+	tls *upstreamTLS
 
 	healthCheck *HealthCheck
 	rate        *rate.Limiter
@@ -103,16 +143,50 @@ type Service struct {
 	name       []byte
 	nameString ServiceNameString
 	ep         *EndpointTableMap
-	onlineEp   *ring.Ring
 
 	// if request method not in the accept http method slice, return HTTP 405
 	// if AcceptHttpMethod slice is empty, allow all http verb.
 	acceptHttpMethod [][]byte
+	// default upstream timeout of the routers bound to this service, zero means not set
+	timeout time.Duration
+	// endpoint selection strategy, round-robin when empty
+	loadBalancer string
+	// request key of the consistent hash balancer: `ip`, `header:<name>` or `cookie:<name>`
+	hashKey string
+	// ramp-up window of endpoints coming back online, zero gives them their full weight at once
+	slowStart time.Duration
+	// optional connection limits of the endpoint pools, zero means using the `client` config
+	maxConns            int
+	maxIdleConnDuration time.Duration
 }
 
 type Router struct {
+	// websocket connections relayed for the router, must be the first field to keep 64-bit alignment for atomic
+	// operations
+	webSocketConns int64
+
 	name   []byte
 	status Status // 0 -> offline, 1 -> online, 2 -> breakdown
+	// optional host pattern, exact host or wildcard like `*.example.com`. Empty means any host
+	host []byte
+	// optional header/query/cookie conditions, all of them must be satisfied
+	predicates []*predicate
+	// optional upstream timeout, zero means using the default of the service
+	timeout time.Duration
+	// optional max attempts of the upstream call, zero means using `client.Retry.MaxAttempts`
+	maxAttempts int
+	// whether non-idempotent requests may be retried
+	retryNonIdempotent bool
+	// closes the client connection after each response, from `KeepAlive=false`
+	disableKeepAlive bool
+	// pipes the response body to the client instead of buffering it, see streamer
+	streaming bool
+	// optional websocket options, nil refuses the upgrade requests
+	webSocket *webSocketRoute
+	// optional traffic split between several services, nil sends everything to `service`
+	split *trafficSplit
+	// optional shadow service receiving a copy of the requests
+	mirror *trafficMirror
 
 	frontendApi *FrontendApi
 	backendApi  *BackendApi
@@ -125,6 +199,15 @@ type TargetServer struct {
 	host []byte
 	uri  []byte
 	svr  []byte
+	// deadline of the upstream call
+	timeout time.Duration
+	// the selected route, its service chosen by the traffic split and the endpoints already tried, used to retry
+	// on another endpoint
+	route   *routeEntry
+	service *serviceEntry
+	tried   []*endpointEntry
+	// value of the `Allow` header, only set along with a method not allowed error
+	allow []byte
 }
 
 func (s Status) String() string {
@@ -207,7 +290,7 @@ func (r *Table) GetEndpointById(id string) (*Endpoint, bool) {
 
 func (r *Table) RemoveRouter(router *Router) (ok bool, err error) {
 
-	_, exists := r.table.Load(router.frontendApi.pathString)
+	_, exists := r.table.Load(RouterNameString(router.name))
 	if !exists {
 		logger.Warn("router not exists")
 		return false, errors.New(125)
@@ -218,14 +301,14 @@ func (r *Table) RemoveRouter(router *Router) (ok bool, err error) {
 		return false, errors.New(132)
 	}
 
-	r.table.Delete(router.frontendApi.pathString)
+	r.table.Delete(RouterNameString(router.name))
 
 	return true, nil
 }
 
 func (r *Table) SetRouterOnline(router *Router) (ok bool, err error) {
 
-	_, exists := r.table.Load(router.frontendApi.pathString)
+	_, exists := r.table.Load(RouterNameString(router.name))
 	if !exists {
 		logger.Warn("router not exists")
 		return false, errors.New(125)
@@ -276,7 +359,7 @@ func (r *Table) SetRouterStatus(router *Router, status Status) (ok bool, err err
 		return r.SetRouterOnline(router)
 	}
 
-	_, exists := r.table.Load(router.frontendApi.pathString)
+	_, exists := r.table.Load(RouterNameString(router.name))
 	if !exists {
 		logger.Warn("router not exists")
 		return false, errors.New(125)
@@ -360,8 +443,8 @@ func (r *Table) SetEndpointStatus(ep *Endpoint, status Status) error {
 				logger.Error(err)
 			}
 		}
-		logger.Debugf("HealthCheck Retry: failedTimes: %d, maxRetryTimes: %d", int(failedTimes), int(ep.healthCheck.retryTime))
-		if int(failedTimes) >= int(ep.healthCheck.retryTime) {
+		logger.Debugf("HealthCheck Retry: failedTimes: %d, maxRetryTimes: %d", int(failedTimes), ep.healthCheck.maxFailedTimes())
+		if int(failedTimes) >= ep.healthCheck.maxFailedTimes() {
 			// exceed max retry times, tag this ep to offline
 			if _, err := utils.PutKV(r.cli, ep.key(constant.StatusKeyString), Offline.String()); err != nil {
 				logger.Error(err)
@@ -383,6 +466,10 @@ func (r *Table) SetEndpointStatus(ep *Endpoint, status Status) error {
 		}
 		ep.setStatus(status)
 		return nil
+	case Draining:
+		// only written by the node itself
+		ep.setStatus(status)
+		return nil
 	default:
 		logger.Warnf("unrecognized status: %s", status.String())
 		return nil
@@ -410,7 +497,7 @@ func (r *Router) setStatus(status Status) {
 }
 
 func (r *Router) equal(another *Router) bool {
-	if bytes.Equal(r.name, another.name) && r.frontendApi.equal(another.frontendApi) &&
+	if bytes.Equal(r.name, another.name) && bytes.Equal(r.host, another.host) && r.frontendApi.equal(another.frontendApi) &&
 		r.backendApi.equal(another.backendApi) && r.status == another.status && r.service.equal(another.service) &&
 		utils.CmpPointerSlice(r.middleware, another.middleware) {
 		return true
@@ -437,6 +524,86 @@ func (r *Router) key(attr ...string) string {
 	}
 }
 
+// setAttr parses an optional attribute of the router, false is returned for attributes which are not optional
+func (r *Router) setAttr(attr string, value []byte) (bool, error) {
+	var err error
+	switch attr {
+	case constant.HostKeyString:
+		r.host = bytes.ToLower(bytes.TrimSpace(value))
+	case constant.MatchKeyString:
+		r.predicates, err = parsePredicates(value)
+	case constant.TimeoutKeyString:
+		r.timeout, err = parseTimeout(value)
+	case constant.MaxAttemptsKeyString:
+		r.maxAttempts, err = parseMaxAttempts(value)
+	case constant.RetryNonIdempotentKeyString:
+		r.retryNonIdempotent, err = strconv.ParseBool(string(value))
+	case constant.KeepAliveKeyString:
+		var keepAlive bool
+		keepAlive, err = strconv.ParseBool(string(value))
+		r.disableKeepAlive = !keepAlive
+	case constant.StreamingKeyString:
+		r.streaming, err = strconv.ParseBool(string(value))
+	case constant.WebSocketKeyString:
+		r.webSocket, err = parseWebSocketRoute(value)
+	case constant.SplitKeyString:
+		r.split, err = parseTrafficSplit(value)
+	case constant.MirrorKeyString:
+		r.mirror, err = parseTrafficMirror(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// copyAttrs replaces the optional attributes of the router with the ones of another
+func (r *Router) copyAttrs(another *Router) {
+	r.host = another.host
+	r.predicates = another.predicates
+	r.timeout = another.timeout
+	r.maxAttempts = another.maxAttempts
+	r.retryNonIdempotent = another.retryNonIdempotent
+	r.disableKeepAlive = another.disableKeepAlive
+	r.streaming = another.streaming
+	r.webSocket = another.webSocket
+	r.split = another.split
+	r.mirror = another.mirror
+}
+
+// setAttr parses an optional attribute of the service, false is returned for attributes which are not optional
+func (s *Service) setAttr(attr string, value []byte) (bool, error) {
+	var err error
+	switch attr {
+	case constant.AcceptHttpMethodKeyString:
+		s.acceptHttpMethod, err = parseAcceptHttpMethod(value)
+	case constant.TimeoutKeyString:
+		s.timeout, err = parseTimeout(value)
+	case constant.LoadBalancerKeyString:
+		s.loadBalancer, err = parseLoadBalancer(value)
+	case constant.HashKeyKeyString:
+		s.hashKey, err = parseHashKey(value)
+	case constant.SlowStartKeyString:
+		s.slowStart, err = parseTimeout(value)
+	case constant.MaxConnsKeyString:
+		s.maxConns, err = parseMaxConns(value)
+	case constant.MaxIdleConnDurationKeyString:
+		s.maxIdleConnDuration, err = parseTimeout(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func isServiceAttr(attr string) bool {
+	switch attr {
+	case constant.AcceptHttpMethodKeyString, constant.TimeoutKeyString, constant.LoadBalancerKeyString,
+		constant.HashKeyKeyString, constant.SlowStartKeyString, constant.MaxConnsKeyString,
+		constant.MaxIdleConnDurationKeyString:
+		return true
+	}
+	return false
+}
+
 func (s *Service) equal(another *Service) bool {
 	if bytes.Equal(s.name, another.name) && s.nameString == another.nameString && s.ep.equal(another.ep) {
 		return true
@@ -459,23 +626,6 @@ func (s *Service) checkEndpointStatus(must Status) (confirm []*Endpoint, rest []
 	return confirm, rest
 }
 
-func (s *Service) ResetOnlineEndpointRing(online []*Endpoint) error {
-	if len(online) == 0 {
-		return errors.New(144)
-	}
-	for idx, ep := range online {
-		newNode := ring.New(1)
-		newNode.Value = ep.nameString
-		if idx == 0 {
-			s.onlineEp = newNode
-		} else {
-			r := s.onlineEp.Link(newNode)
-			newNode.Link(r)
-		}
-	}
-	return nil
-}
-
 func (ep *Endpoint) key(attr ...string) string {
 	if len(attr) > 0 {
 		return constant.NodeDefinition + fmt.Sprintf(constant.NodePrefixString, ep.id) + attr[0]
@@ -497,54 +647,48 @@ func (ep *Endpoint) setStatus(status Status) {
 	ep.status = status
 }
 
-func (r *Table) Select(input []byte, method []byte) (TargetServer, error) {
-	var replacedBackendUri []byte
-	var matchRouter *Router
+// Select chooses the route and the endpoint of the request. The in-flight slot of the endpoint is taken as soon as it is
+// picked, the caller gives it back with the release of the target.
+func (r *Table) Select(ctx *fasthttp.RequestCtx) (TargetServer, error) {
+	host := normalizeHost(ctx.Host())
+	if !r.acceptHost(host) {
+		return TargetServer{}, errors.New(145)
+	}
+	snap := r.loadSnapshot()
+	if snap == nil {
+		return TargetServer{}, errors.New(142)
+	}
 
-	input = []byte(string(method) + "@" + string(input))
+	method := ctx.Method()
+	input := []byte(string(method) + methodSeparator + string(ctx.Path()))
 	inputByteSlice := bytes.Split(input, UriSlash)
-	r.onlineTable.Range(func(key *FrontendApi, value *Router) bool {
-		matched, replaced := match(inputByteSlice, key.pattern, value.backendApi.pattern)
-		if matched && value.status == Online {
-			matchRouter = value
-			replacedBackendUri = replaced
-			return true
-		}
-		return false
+	route := snap.lookup(host, inputByteSlice, func(route *routeEntry) bool {
+		return route.service.acceptMethod(method) && route.matchPredicates(&ctx.Request)
 	})
-
-	if matchRouter == nil {
+	if route == nil {
+		// the path may still be routed for other methods
+		if allow := snap.allowedMethods(host, inputByteSlice, &ctx.Request); allow != nil {
+			return TargetServer{allow: allow}, errors.New(146)
+		}
 		return TargetServer{}, errors.New(142)
 	}
-	if matchRouter.status != Online {
-		return TargetServer{}, errors.New(143)
-	}
+	_, replacedBackendUri := match(inputByteSlice, route.frontend, route.backend)
 
-	counts := 0
-	for {
-		counts++
-		if counts > matchRouter.service.onlineEp.Len() {
-			break
-		}
-		next := matchRouter.service.onlineEp.Value
-		matchRouter.service.onlineEp = matchRouter.service.onlineEp.Move(1)
-		_, ok := next.(EndpointNameString)
-		if !ok {
-			return TargetServer{}, errors.New(140)
-		}
-		ep, exists := matchRouter.service.ep.Load(next.(EndpointNameString))
-		if !exists {
-			return TargetServer{}, errors.New(123)
-		}
-		if ep.status == Online {
-			return TargetServer{
-				host: bytes.Join([][]byte{ep.host, []byte(strconv.FormatInt(int64(ep.port), 10))}, []byte(":")),
-				uri:  replacedBackendUri,
-				svr:  matchRouter.service.name,
-			}, nil
-		}
+	svr := route.selectService(ctx)
+	ep := svr.pick(ctx, nil)
+	if ep == nil {
+		return TargetServer{}, errors.New(141)
 	}
-	return TargetServer{}, errors.New(141)
+	ep.stats.acquire()
+	return TargetServer{
+		host:    ep.addr,
+		uri:     replacedBackendUri,
+		svr:     svr.name,
+		timeout: route.timeout,
+		route:   route,
+		service: svr,
+		tried:   []*endpointEntry{ep},
+	}, nil
 }
 
 func match(input, pattern, backend [][]byte) (bool, []byte) {
@@ -560,7 +704,7 @@ func match(input, pattern, backend [][]byte) (bool, []byte) {
 				hasAny = true
 				break
 			} else if bytes.HasPrefix(pattern[i], VariableIdentifier) {
-				replaced[string(pattern[i])] = input[i]
+				replaced[string(paramName(pattern[i]))] = input[i]
 			} else if !bytes.Equal(pattern[i], input[i]) {
 				return false, nil
 			}
@@ -1,8 +1,36 @@
 package routing
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMatch(t *testing.T) {
@@ -37,4 +65,1545 @@ func TestMatch(t *testing.T) {
 	} else if !bytes.Equal(replace, []byte("GET@/backend/v1/update/123")) {
 		t.FailNow()
 	}
+
+	input = bytes.Split([]byte("GET@/front/test/123"), UriSlash)
+	pattern = bytes.Split([]byte("GET@/front/test/:test_id<int>"), UriSlash)
+	backend = bytes.Split([]byte("GET@/backend/test/:test_id"), UriSlash)
+	ok, replace = match(input, pattern, backend)
+	if !ok {
+		t.FailNow()
+	} else if !bytes.Equal(replace, []byte("GET@/backend/test/123")) {
+		t.FailNow()
+	}
+}
+
+func TestNewFrontendApi(t *testing.T) {
+	api, err := newFrontendApi([]byte("GET@/front/:id{[0-9]{2,4}}/:name<alpha>/:other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.constraints) != len(api.pattern) {
+		t.FailNow()
+	}
+	if api.constraints[0] != nil || api.constraints[1] != nil || api.constraints[4] != nil {
+		t.FailNow()
+	}
+	if !api.constraints[2].MatchString("123") || api.constraints[2].MatchString("12345") {
+		t.FailNow()
+	}
+	if !api.constraints[3].MatchString("abc") || api.constraints[3].MatchString("abc1") {
+		t.FailNow()
+	}
+
+	for _, path := range []string{"GET@/front/:id{[0-9]+", "GET@/front/:id<unknown>", "GET@/front/:id{[0-9}"} {
+		if _, err := newFrontendApi([]byte(path)); err == nil {
+			t.Fatalf("%s: expected error", path)
+		}
+	}
+}
+
+func TestHostMatch(t *testing.T) {
+	if host := normalizeHost([]byte("API.Example.com:8800")); host != "api.example.com" {
+		t.Fatalf("unexpected normalized host: %s", host)
+	}
+	if host := normalizeHost([]byte("[::1]:8800")); host != "[::1]" {
+		t.Fatalf("unexpected normalized host: %s", host)
+	}
+	if !hostMatch("api.example.com", "api.example.com") || hostMatch("api.example.com", "www.example.com") {
+		t.FailNow()
+	}
+	if !hostMatch("*.example.com", "api.example.com") || !hostMatch("*.example.com", "a.b.example.com") {
+		t.FailNow()
+	}
+	if hostMatch("*.example.com", "example.com") || hostMatch("*.example.com", "badexample.com") {
+		t.FailNow()
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	readOnly := &serviceEntry{name: []byte("read"), methods: [][]byte{[]byte("GET")}}
+	all := &serviceEntry{name: []byte("all")}
+	get := newTestRoute("get", "GET@/front/:id")
+	get.service = readOnly
+	put := newTestRoute("put", "PUT@/front/:id")
+	put.service = readOnly
+	post := newTestRoute("post", "POST@/front/:id")
+	post.service = all
+	snap := &snapshot{
+		tree:    newRouteTree([]*routeEntry{get, put, post}),
+		methods: []string{"GET", "POST", "PUT"},
+	}
+
+	var req fasthttp.Request
+	input := bytes.Split([]byte("PUT@/front/1"), UriSlash)
+	if allow := snap.allowedMethods("", input, &req); string(allow) != "GET, POST, OPTIONS" {
+		t.Fatalf("unexpected allow header: %s", allow)
+	}
+	input = bytes.Split([]byte("OPTIONS@/other/1"), UriSlash)
+	if allow := snap.allowedMethods("", input, &req); allow != nil {
+		t.Fatalf("unexpected allow header: %s", allow)
+	}
+	// the only router of the path is refused by its service, the path is still routed
+	input = bytes.Split([]byte("PUT@/refused/1"), UriSlash)
+	refused := newTestRoute("refused", "PUT@/refused/:id")
+	refused.service = readOnly
+	snap.tree = newRouteTree([]*routeEntry{get, put, post, refused})
+	if allow := snap.allowedMethods("", input, &req); string(allow) != "OPTIONS" {
+		t.Fatalf("unexpected allow header: %s", allow)
+	}
+	r := newTestTable()
+	svr := newTestService(map[string]int{"a": 1})
+	svr.acceptHttpMethod = [][]byte{[]byte("GET")}
+	addTestRouter(t, r, "refused", "PUT@/refused/:id", svr, nil)
+	r.publish()
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("PUT")
+	ctx.Request.SetRequestURI("/refused/1")
+	ctx.SetUserValue("Table", r)
+	ReverseProxyHandler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusMethodNotAllowed || string(ctx.Response.Header.Peek("Allow")) != "OPTIONS" {
+		t.Fatalf("unexpected response: %d, allow: %s", ctx.Response.StatusCode(), ctx.Response.Header.Peek("Allow"))
+	}
+	if readOnly.acceptMethod([]byte("PUT")) || !readOnly.acceptMethod([]byte("GET")) || !all.acceptMethod([]byte("PUT")) {
+		t.FailNow()
+	}
+}
+
+// newTestTable returns a table without etcd, routers are added with addTestRouter
+func newTestTable() *Table {
+	r := &Table{stats: newEndpointStatsMap(), balances: newServiceBalanceMap()}
+	r.table.internal = make(map[RouterNameString]*Router)
+	r.onlineTable.internal = make(map[*FrontendApi]*Router)
+	r.serviceTable.internal = make(map[ServiceNameString]*Service)
+	r.endpointTable.internal = make(map[EndpointNameString]*Endpoint)
+	r.routerTable.internal = make(map[RouterNameString]*Router)
+	return r
+}
+
+// addTestRouter registers an online router and its service like the watchers do, the attributes are the optional
+// router keys of etcd
+func addTestRouter(t *testing.T, r *Table, name, frontend string, svr *Service, attrs map[string]string) *Router {
+	api, err := newFrontendApi([]byte(frontend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{
+		name:        []byte(name),
+		status:      Online,
+		frontendApi: api,
+		backendApi:  &BackendApi{path: []byte(frontend), pattern: bytes.Split([]byte(frontend), UriSlash)},
+		service:     svr,
+	}
+	for attr, value := range attrs {
+		if _, err := router.setAttr(attr, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svr.nameString = ServiceNameString(svr.name)
+	r.serviceTable.Store(svr.nameString, svr)
+	svr.ep.Range(func(key EndpointNameString, value *Endpoint) bool {
+		r.endpointTable.Store(key, value)
+		return false
+	})
+	r.routerTable.Store(RouterNameString(name), router)
+	r.table.Store(RouterNameString(name), router)
+	r.onlineTable.Store(api, router)
+	return router
+}
+
+// selectRoute returns the name of the router selected for the request
+func selectRoute(r *Table, method, host, path string, headers map[string]string) (string, error) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetHost(host)
+	for k, v := range headers {
+		ctx.Request.Header.Set(k, v)
+	}
+	target, err := r.Select(&ctx)
+	if err != nil {
+		return "", err
+	}
+	target.release()
+	return string(target.route.name), nil
+}
+
+func errCode(err error) int {
+	if e, ok := err.(errors.Error); ok {
+		return int(e.ErrCode)
+	}
+	return 0
+}
+
+func TestPublish(t *testing.T) {
+	r := newTestTable()
+	svr := newTestService(map[string]int{"a": 1})
+	addTestRouter(t, r, "first", "GET@/first", svr, nil)
+	r.publish()
+	if name, err := selectRoute(r, "GET", "example.com", "/first", nil); err != nil || name != "first" {
+		t.Fatalf("unexpected route: %s, err: %v", name, err)
+	}
+	// the requests keep using the published snapshot until the next publish
+	addTestRouter(t, r, "second", "GET@/second", svr, nil)
+	if _, err := selectRoute(r, "GET", "example.com", "/second", nil); errCode(err) != 142 {
+		t.Fatalf("unpublished router selected, err: %v", err)
+	}
+	r.publish()
+	if name, err := selectRoute(r, "GET", "example.com", "/second", nil); err != nil || name != "second" {
+		t.Fatalf("unexpected route: %s, err: %v", name, err)
+	}
+
+	// two routers going online and offline together are seen together by the readers
+	x := addTestRouter(t, r, "x", "GET@/pair/x", svr, nil)
+	y := addTestRouter(t, r, "y", "GET@/pair/y", svr, nil)
+	acceptAll := func(route *routeEntry) bool { return true }
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := r.loadSnapshot()
+				foundX := snap.lookup("", bytes.Split([]byte("GET@/pair/x"), UriSlash), acceptAll) != nil
+				foundY := snap.lookup("", bytes.Split([]byte("GET@/pair/y"), UriSlash), acceptAll) != nil
+				if foundX != foundY || snap.lookup("", bytes.Split([]byte("GET@/first"), UriSlash), acceptAll) == nil {
+					t.Errorf("partial snapshot: x %t, y %t", foundX, foundY)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		r.publish()
+		r.onlineTable.Delete(x.frontendApi)
+		r.onlineTable.Delete(y.frontendApi)
+		r.publish()
+		r.onlineTable.Store(x.frontendApi, x)
+		r.onlineTable.Store(y.frontendApi, y)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestSelect(t *testing.T) {
+	r := newTestTable()
+	r.listenDomain = []string{"example.com", "*.example.com"}
+	svr := newTestService(map[string]int{"a": 1})
+	addTestRouter(t, r, "any", "GET@/users/:id<int>", svr, nil)
+	addTestRouter(t, r, "api", "GET@/users/:id<int>", svr, map[string]string{constant.HostKeyString: "api.example.com"})
+	addTestRouter(t, r, "beta", "GET@/users/:id<int>", svr, map[string]string{
+		constant.HostKeyString:  "api.example.com",
+		constant.MatchKeyString: `[{"Type": "header", "Name": "X-Beta", "Value": "1"}]`,
+	})
+	addTestRouter(t, r, "wildcard", "GET@/users/:id<int>", svr, map[string]string{constant.HostKeyString: "*.example.com"})
+	r.publish()
+
+	for _, c := range []struct {
+		host     string
+		path     string
+		headers  map[string]string
+		expected string
+	}{
+		{"api.example.com", "/users/1", nil, "api"},
+		{"API.example.com:8080", "/users/1", map[string]string{"X-Beta": "1"}, "beta"},
+		{"api.example.com", "/users/1", map[string]string{"X-Beta": "2"}, "api"},
+		{"www.example.com", "/users/1", nil, "wildcard"},
+		{"example.com", "/users/1", nil, "any"},
+	} {
+		if name, err := selectRoute(r, "GET", c.host, c.path, c.headers); err != nil || name != c.expected {
+			t.Fatalf("%s%s: unexpected route %s, expected %s, err: %v", c.host, c.path, name, c.expected, err)
+		}
+	}
+	// the constraint of the parameter is part of the match
+	if _, err := selectRoute(r, "GET", "api.example.com", "/users/abc", nil); errCode(err) != 142 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// hosts outside the listen domains are misdirected
+	if _, err := selectRoute(r, "GET", "example.org", "/users/1", nil); errCode(err) != 145 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/users/1")
+	ctx.Request.Header.SetHost("example.org")
+	ctx.SetUserValue("Table", r)
+	ReverseProxyHandler(&ctx)
+	if ctx.Response.StatusCode() != statusMisdirectedRequest {
+		t.Fatalf("unexpected status: %d", ctx.Response.StatusCode())
+	}
+
+	// the in-flight slot is taken by Select and given back whatever the answer, the endpoint is unreachable here
+	var selected fasthttp.RequestCtx
+	selected.Request.SetRequestURI("/users/1")
+	selected.Request.Header.SetHost("example.com")
+	target, err := r.Select(&selected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := target.endpoint().stats
+	if stats.outstanding() != 1 {
+		t.Fatalf("slot not taken on selection: %d", stats.outstanding())
+	}
+	target.release()
+	r.retry = newRetryPolicy()
+	r.outlier = newOutlierDetector()
+	selected.SetUserValue("Table", r)
+	ReverseProxyHandler(&selected)
+	if selected.Response.StatusCode() != fasthttp.StatusInternalServerError || stats.outstanding() != 0 {
+		t.Fatalf("unexpected status: %d, inflight: %d", selected.Response.StatusCode(), stats.outstanding())
+	}
+}
+
+func TestRouterSharedPath(t *testing.T) {
+	r := newTestTable()
+	r.cli = newMemoryClient()
+	svr := newTestService(map[string]int{"a": 1})
+	addTestRouter(t, r, "other", "GET@/other", svr, nil)
+	for _, name := range []string{"a", "b"} {
+		key := constant.RouterDefinition + fmt.Sprintf(constant.RouterPrefixString, name)
+		for attr, value := range map[string]string{
+			constant.NameKeyString:        name,
+			constant.FrontendApiKeyString: "GET@/users",
+			constant.BackendApiKeyString:  "GET@/users",
+			constant.ServiceKeyString:     string(svr.name),
+			constant.HostKeyString:        name + ".example.com",
+		} {
+			_, _ = r.cli.Put(context.Background(), key+attr, value)
+		}
+		if err := r.CreateRouter(name, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.publish()
+	for _, name := range []string{"a", "b"} {
+		if got, err := selectRoute(r, "GET", name+".example.com", "/users", nil); err != nil || got != name {
+			t.Fatalf("unexpected route: %s, expected %s, err: %v", got, name, err)
+		}
+	}
+
+	// deleting a router leaves the other router of the path registered
+	if err := r.DeleteRouter("a"); err != nil {
+		t.Fatal(err)
+	}
+	r.publish()
+	if _, err := selectRoute(r, "GET", "a.example.com", "/users", nil); errCode(err) != 142 {
+		t.Fatalf("deleted router selected, err: %v", err)
+	}
+	if got, err := selectRoute(r, "GET", "b.example.com", "/users", nil); err != nil || got != "b" {
+		t.Fatalf("unexpected route: %s, err: %v", got, err)
+	}
+	b, err := r.GetRouterByName([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.SetRouterStatus(b, BreakDown); err != nil {
+		t.Fatalf("router of a shared path not found: %v", err)
+	}
+	r.publish()
+	if _, err := selectRoute(r, "GET", "b.example.com", "/users", nil); errCode(err) != 142 {
+		t.Fatalf("broken down router still published, err: %v", err)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	timeout, err := parseTimeout([]byte("2000"))
+	if err != nil || timeout != 2*time.Second {
+		t.Fatalf("unexpected timeout: %s, err: %v", timeout, err)
+	}
+	if _, err := parseTimeout([]byte("2s")); err == nil {
+		t.FailNow()
+	}
+
+	svr := &Service{}
+	router := &Router{service: svr}
+	if upstreamTimeout(router) != defaultUpstreamTimeout {
+		t.FailNow()
+	}
+	svr.timeout = 120 * time.Second
+	if upstreamTimeout(router) != 120*time.Second {
+		t.FailNow()
+	}
+	router.timeout = 2 * time.Second
+	if upstreamTimeout(router) != 2*time.Second {
+		t.FailNow()
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := &retryPolicy{
+		maxAttempts: 2,
+		retryOn:     map[int]bool{fasthttp.StatusBadGateway: true},
+		budget:      newRetryBudget(0.2, 100),
+	}
+	target := &TargetServer{route: &routeEntry{}}
+	get, post := []byte(fasthttp.MethodGet), []byte(fasthttp.MethodPost)
+
+	if !p.shouldRetry(target, 1, get, fasthttp.ErrConnectionClosed, 0) {
+		t.Fatal("connection error should be retried")
+	}
+	if !p.shouldRetry(target, 1, get, nil, fasthttp.StatusBadGateway) {
+		t.Fatal("configured status should be retried")
+	}
+	if p.shouldRetry(target, 1, get, nil, fasthttp.StatusInternalServerError) {
+		t.Fatal("unconfigured status should not be retried")
+	}
+	if p.shouldRetry(target, 1, get, fasthttp.ErrTimeout, 0) {
+		t.Fatal("timeout should not be retried")
+	}
+	if p.shouldRetry(target, 2, get, fasthttp.ErrConnectionClosed, 0) {
+		t.Fatal("max attempts exceeded")
+	}
+	if p.shouldRetry(target, 1, post, fasthttp.ErrConnectionClosed, 0) {
+		t.Fatal("non-idempotent request should not be retried")
+	}
+	target.route.retryNonIdempotent = true
+	target.route.maxAttempts = 3
+	if !p.shouldRetry(target, 2, post, fasthttp.ErrConnectionClosed, 0) {
+		t.Fatal("router overrides should be applied")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 1)
+	// the fixed rate allows one retry
+	if !b.withdraw() || b.withdraw() {
+		t.FailNow()
+	}
+	b.deposit()
+	if b.withdraw() {
+		t.Fatal("half a token should not allow a retry")
+	}
+	b.deposit()
+	b.deposit()
+	if !b.withdraw() || b.withdraw() {
+		t.FailNow()
+	}
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+	}
+	if b.tokens != maxRetryTokens {
+		t.Fatalf("unexpected tokens: %d", b.tokens)
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	a := &endpointEntry{name: "a", addr: []byte("127.0.0.1:1"), stats: &endpointStats{}}
+	b := &endpointEntry{name: "b", addr: []byte("127.0.0.1:2"), stats: &endpointStats{}}
+	svr := &serviceEntry{endpoints: []*endpointEntry{a, b}, balance: newServiceBalance()}
+	ep := svr.next()
+	ep.stats.acquire()
+	target := &TargetServer{host: ep.addr, route: &routeEntry{service: svr}, service: svr, tried: []*endpointEntry{ep}}
+
+	if !target.retarget(nil) || bytes.Equal(target.host, ep.addr) {
+		t.Fatal("expected another endpoint")
+	}
+	// the in-flight slot follows the target
+	if ep.stats.outstanding() != 0 || target.endpoint().stats.outstanding() != 1 {
+		t.Fatalf("unexpected inflight: %d, %d", ep.stats.outstanding(), target.endpoint().stats.outstanding())
+	}
+	// every endpoint has been tried, endpoints are reused
+	if !target.retarget(nil) || len(target.tried) != 3 {
+		t.FailNow()
+	}
+	target.release()
+	if a.stats.outstanding() != 0 || b.stats.outstanding() != 0 {
+		t.Fatalf("endpoint not released: %d, %d", a.stats.outstanding(), b.stats.outstanding())
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	if _, err := parseTrafficSplit([]byte(`{"Services": [{"Service": "a", "Weight": -1}]}`)); err == nil {
+		t.Fatal("expected negative weight error")
+	}
+	if _, err := parseTrafficSplit([]byte(`{"Services": [{"Service": "a", "Weight": 1}], "Override": "query:v"}`)); err == nil {
+		t.Fatal("expected override error")
+	}
+	split, err := parseTrafficSplit([]byte(`{"Services": [{"Service": "v1", "Weight": 95}, {"Service": "v2", "Weight": 5},
+		{"Service": "v3", "Weight": 10}], "Override": "Header:X-Canary"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if split.Override != "header:X-Canary" {
+		t.Fatalf("unexpected override: %s", split.Override)
+	}
+
+	ep := &endpointEntry{name: "a", addr: []byte("127.0.0.1:1")}
+	services := map[string]*serviceEntry{
+		"v1": {name: []byte("v1"), endpoints: []*endpointEntry{ep}, balance: newServiceBalance()},
+		"v2": {name: []byte("v2"), endpoints: []*endpointEntry{ep}, balance: newServiceBalance()},
+		// no online endpoint, left out of the split
+		"v3": {name: []byte("v3"), balance: newServiceBalance()},
+	}
+	route := &routeEntry{
+		service: services["v1"],
+		split: newSplitEntry(split, func(name string) *serviceEntry {
+			return services[name]
+		}),
+	}
+	if len(route.split.services) != 2 || route.split.bounds[1] != 100 {
+		t.Fatalf("unexpected split: %v", route.split.bounds)
+	}
+
+	count := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		count[string(route.selectService(nil).name)]++
+	}
+	if count["v2"] < 300 || count["v2"] > 700 || count["v3"] != 0 {
+		t.Fatalf("unexpected distribution: %v", count)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("X-Canary", "v2")
+	for i := 0; i < 100; i++ {
+		if string(route.selectService(ctx).name) != "v2" {
+			t.Fatal("expected the override service")
+		}
+	}
+	// unknown services are ignored
+	ctx.Request.Header.Set("X-Canary", "v3")
+	if route.selectService(ctx) == nil {
+		t.FailNow()
+	}
+	// methods refused by the split service stay on the service of the route
+	services["v2"].methods = [][]byte{[]byte(fasthttp.MethodPost)}
+	ctx.Request.Header.Set("X-Canary", "v2")
+	if string(route.selectService(ctx).name) != "v1" {
+		t.Fatal("expected the service of the route for a refused method")
+	}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	if string(route.selectService(ctx).name) != "v2" {
+		t.Fatal("expected the override service for an accepted method")
+	}
+}
+
+func TestTrafficMirror(t *testing.T) {
+	mirror, err := parseTrafficMirror([]byte(`{"Service": "shadow"}`))
+	if err != nil || mirror.Percent != 100 {
+		t.Fatalf("unexpected mirror: %v, err: %v", mirror, err)
+	}
+	if _, err := parseTrafficMirror([]byte(`{"Service": "shadow", "Percent": 101}`)); err == nil {
+		t.Fatal("expected percent error")
+	}
+
+	received := make(chan string, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		received <- string(ctx.Path()) + " " + string(ctx.Request.Header.Peek(mirrorHeader))
+	})
+
+	ep := &endpointEntry{name: "shadow", addr: []byte(ln.Addr().String()), stats: &endpointStats{}}
+	services := map[string]*serviceEntry{"shadow": {name: []byte("shadow"), endpoints: []*endpointEntry{ep}, balance: newServiceBalance()}}
+	resolve := func(name string) *serviceEntry {
+		return services[name]
+	}
+	if newMirrorEntry(&trafficMirror{Service: "absent", Percent: 100}, resolve) != nil {
+		t.Fatal("expected no mirror without service")
+	}
+	target := &TargetServer{
+		timeout: time.Second,
+		route:   &routeEntry{name: []byte("order"), mirror: newMirrorEntry(mirror, resolve)},
+	}
+	req := &fasthttp.Request{}
+	uri := &fasthttp.URI{}
+	uri.SetScheme("http")
+	uri.SetPath("/order/1")
+
+	m := &mirrorer{slots: make(chan struct{}, 1)}
+	m.send(nil, target, req, uri)
+	select {
+	case got := <-received:
+		if got != "/order/1 order" {
+			t.Fatalf("unexpected mirrored request: %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	// copies are dropped when every slot is taken
+	m.slots <- struct{}{}
+	m.send(nil, target, req, uri)
+	select {
+	case <-received:
+		t.Fatal("expected the copy to be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a dropped copy does not take the probe of a half-open endpoint
+	ep.stats.ejectedUntil = time.Now().Add(-time.Second).UnixNano()
+	m.send(nil, target, req, uri)
+	if !ep.stats.available(time.Now().UnixNano()) {
+		t.Fatal("probe claimed by a dropped copy")
+	}
+	m.outlier = &outlierDetector{baseEjectionTime: int64(time.Hour), maxEjectionTime: int64(time.Hour)}
+	<-m.slots
+	m.send(nil, target, req, uri)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("probe not mirrored")
+	}
+	for i := 0; i < 100 && ep.stats.ejected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ep.stats.ejected() {
+		t.Fatal("expected the endpoint back after the mirrored probe")
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(3 * time.Second)
+	})
+	addr := ln.Addr().(*net.TCPAddr)
+
+	hc := &HealthCheck{path: []byte("/check"), timeout: 1}
+	if hc.intervalDuration() != defaultHealthCheckInterval || hc.maxFailedTimes() != 0 {
+		t.FailNow()
+	}
+	start := time.Now()
+	if ok, err := hc.Check([]byte("127.0.0.1"), addr.Port); ok || err == nil {
+		t.Fatal("expected the check to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("check not bounded by its timeout: %s", elapsed)
+	}
+}
+
+func TestHealthCheckTypes(t *testing.T) {
+	if _, err := parseHealthCheckType([]byte("udp")); err == nil {
+		t.Fatal("expected unsupported type error")
+	}
+	if typ, err := parseHealthCheckType([]byte(" GRPC ")); err != nil || typ != grpcHealthCheck {
+		t.Fatalf("unexpected type: %s, err: %v", typ, err)
+	}
+	port := func(addr string) int {
+		_, p, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(p)
+		return n
+	}
+	host := []byte("127.0.0.1")
+
+	// tcp
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := &HealthCheck{typ: tcpHealthCheck, timeout: 1}
+	if ok, err := tcp.Check(host, port(ln.Addr().String())); !ok || err != nil {
+		t.Fatalf("tcp check failed: %v", err)
+	}
+	closed := port(ln.Addr().String())
+	ln.Close()
+	if ok, _ := tcp.Check(host, closed); ok {
+		t.Fatal("expected tcp check to fail on a closed port")
+	}
+
+	// https with a self-signed certificate
+	tlsSvr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tlsSvr.Close()
+	https := &HealthCheck{typ: httpsHealthCheck, path: []byte("/check"), timeout: 1}
+	if ok, err := https.Check(host, port(tlsSvr.Listener.Addr().String())); !ok || err != nil {
+		t.Fatalf("https check failed: %v", err)
+	}
+
+	// grpc health protocol
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcSvr := grpc.NewServer()
+	healthSvr := health.NewServer()
+	healthSvr.SetServingStatus("orders", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(grpcSvr, healthSvr)
+	go grpcSvr.Serve(grpcLn)
+	defer grpcSvr.Stop()
+	grpcCheck := &HealthCheck{typ: grpcHealthCheck, path: []byte("/"), timeout: 1}
+	if ok, err := grpcCheck.Check(host, port(grpcLn.Addr().String())); !ok || err != nil {
+		t.Fatalf("grpc check failed: %v", err)
+	}
+	grpcCheck.path = []byte("orders")
+	if ok, _ := grpcCheck.Check(host, port(grpcLn.Addr().String())); ok {
+		t.Fatal("expected grpc check to fail on a not serving service")
+	}
+}
+
+func TestHealthCheckAssertions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Host()) != "orders.internal" || string(ctx.Request.Header.Peek("X-Token")) != "secret" {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+		ctx.SetBodyString(`{"status":"` + string(ctx.Method()) + `"}`)
+	})
+	port := ln.Addr().(*net.TCPAddr).Port
+	host := []byte("127.0.0.1")
+
+	hc := &HealthCheck{path: []byte("/check"), timeout: 1}
+	for attr, value := range map[string]string{
+		constant.MethodKeyString:       "head",
+		constant.HostKeyString:         "Orders.Internal",
+		constant.HeadersKeyString:      `{"X-Token": "secret"}`,
+		constant.ExpectStatusKeyString: `[200, 202]`,
+	} {
+		if ok, err := hc.setAttr(attr, []byte(value)); !ok || err != nil {
+			t.Fatalf("set %s failed: %v", attr, err)
+		}
+	}
+	if ok, err := hc.Check(host, port); !ok || err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	hc.method = []byte("GET")
+	hc.bodyContains = []byte(`"status":"degraded"`)
+	if ok, _ := hc.Check(host, port); ok {
+		t.Fatal("expected body assertion to fail")
+	}
+	hc.bodyContains = nil
+	if _, err := hc.setAttr(constant.BodyRegexKeyString, []byte(`"status":"(GET|ok)"`)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := hc.Check(host, port); !ok || err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	hc.expectStatus = []int{200}
+	if ok, _ := hc.Check(host, port); ok {
+		t.Fatal("expected status assertion to fail")
+	}
+	hc.headers = nil
+	hc.expectStatus = nil
+	if ok, _ := hc.Check(host, port); ok {
+		t.Fatal("expected 403 without the header")
+	}
+
+	if _, err := hc.setAttr(constant.ExpectStatusKeyString, []byte(`[99]`)); err == nil {
+		t.Fatal("expected invalid status error")
+	}
+	if _, err := hc.setAttr(constant.BodyRegexKeyString, []byte(`(`)); err == nil {
+		t.Fatal("expected invalid regex error")
+	}
+}
+
+func TestDraining(t *testing.T) {
+	svr := newTestService(map[string]int{"a": 1, "b": 1})
+	b, _ := svr.ep.Load("b")
+	b.status = Draining
+	b.healthCheck = &HealthCheck{path: []byte("/check")}
+	entry := newServiceEntry(svr, newEndpointStatsMap())
+	if len(entry.endpoints) != 1 || entry.endpoints[0].name != "a" {
+		t.Fatalf("draining endpoint still balanced: %d", len(entry.endpoints))
+	}
+
+	r := &Table{
+		checks: make(map[EndpointNameString]*healthCheckState),
+		stats:  newEndpointStatsMap(),
+		drain:  &drainReporter{instance: "gw", snapshots: make(chan map[string]int64, 1), reported: make(map[string]int64)},
+	}
+	r.endpointTable.internal = map[EndpointNameString]*Endpoint{"b": b}
+	r.scheduleHealthCheck(time.Now())
+	if r.checks["b"].isRunning() {
+		t.Fatal("draining endpoint health checked")
+	}
+	// a check started before the node began draining must not bring it back
+	if r.applyHealthCheck(b, Online, true) || b.status != Draining {
+		t.Fatalf("unexpected status: %s", b.status)
+	}
+	// only the latest snapshot is handed to the reporter
+	stats := r.stats.LoadOrCreate("b")
+	stats.acquire()
+	r.reportDraining()
+	stats.acquire()
+	r.reportDraining()
+	snapshot := <-r.drain.snapshots
+	if len(snapshot) != 1 || snapshot[b.id] != 2 || len(r.drain.snapshots) != 0 {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+	// without etcd nothing is reported
+	r.drain.report(snapshot)
+	if len(r.drain.reported) != 0 {
+		t.Fatalf("unexpected reports: %v", r.drain.reported)
+	}
+}
+
+func TestRefreshEndpointStatus(t *testing.T) {
+	r := newTestTable()
+	r.cli = newMemoryClient()
+	// nodes without health check follow the status of etcd too
+	ep := &Endpoint{id: "n1", name: []byte("n1"), nameString: "n1", host: []byte("127.0.0.1"), port: 80, status: Online}
+	r.endpointTable.Store(ep.nameString, ep)
+	for key, value := range map[string]string{
+		constant.IdKeyString:     "n1",
+		constant.NameKeyString:   "n1",
+		constant.HostKeyString:   "127.0.0.1",
+		constant.PortKeyString:   "80",
+		constant.StatusKeyString: Draining.String(),
+	} {
+		if _, err := r.cli.Put(context.Background(), ep.key(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.RefreshEndpoint(ep, ep.key()); err != nil {
+		t.Fatal(err)
+	}
+	if ep.status != Draining {
+		t.Fatalf("unexpected status: %s", ep.status)
+	}
+}
+
+// memoryKV keeps the keys of the tests in memory, only gets of a key or a prefix and puts are supported
+type memoryKV struct {
+	clientv3.KV
+	sync.Mutex
+	kvs map[string]string
+}
+
+func newMemoryClient() *clientv3.Client {
+	return &clientv3.Client{KV: &memoryKV{kvs: make(map[string]string)}}
+}
+
+func (m *memoryKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+	resp := &clientv3.GetResponse{}
+	end := string(clientv3.OpGet(key, opts...).RangeBytes())
+	for k, value := range m.kvs {
+		if k == key || (end != "" && k > key && k < end) {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(value)})
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0
+	})
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (m *memoryKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.kvs[key] = val
+	return &clientv3.PutResponse{}, nil
+}
+
+func TestHealthCheckSchedule(t *testing.T) {
+	var healthy int32
+	var hitsA, hitsB int32
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hitsA, 1)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hitsB, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer b.Close()
+	newEndpoint := func(name string, addr net.Addr, hc *HealthCheck) *Endpoint {
+		return &Endpoint{
+			id:          name,
+			name:        []byte(name),
+			nameString:  EndpointNameString(name),
+			host:        []byte("127.0.0.1"),
+			port:        addr.(*net.TCPAddr).Port,
+			status:      Online,
+			healthCheck: hc,
+		}
+	}
+	epA := newEndpoint("a", a.Listener.Addr(), &HealthCheck{path: []byte("/check"), interval: 1})
+	// a failed check is retried once, the second failed check sets it offline
+	epB := newEndpoint("b", b.Listener.Addr(), &HealthCheck{path: []byte("/check"), interval: 3, retry: true, retryTime: 1})
+	epA.status = Offline
+
+	r := &Table{
+		cli:    newMemoryClient(),
+		events: NewEvents(),
+		checks: make(map[EndpointNameString]*healthCheckState),
+	}
+	r.endpointTable.internal = map[EndpointNameString]*Endpoint{"a": epA, "b": epB}
+	// run plays one tick of the event goroutine and applies the results of the checks it started, only the results
+	// which change an endpoint are posted
+	var posted int
+	run := func(now time.Time) {
+		posted = 0
+		r.scheduleHealthCheck(now)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			select {
+			case msg := <-r.events.watchCh:
+				if !msg.handle() {
+					t.Fatal("unchanged health check result posted")
+				}
+				posted++
+				continue
+			default:
+			}
+			running := false
+			for _, state := range r.checks {
+				if state.isRunning() {
+					running = true
+				}
+			}
+			if !running {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("health check not finished")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	expect := func(step string, results int, a, b int32, statusA, statusB Status) {
+		if posted != results {
+			t.Fatalf("%s: %d results posted, expected %d", step, posted, results)
+		}
+		if got := atomic.LoadInt32(&hitsA); got != a {
+			t.Fatalf("%s: endpoint a checked %d times, expected %d", step, got, a)
+		}
+		if got := atomic.LoadInt32(&hitsB); got != b {
+			t.Fatalf("%s: endpoint b checked %d times, expected %d", step, got, b)
+		}
+		if epA.status != statusA || epB.status != statusB {
+			t.Fatalf("%s: unexpected status %s, %s", step, epA.status, epB.status)
+		}
+	}
+
+	start := time.Now()
+	run(start)
+	expect("first tick", 2, 1, 2, Online, BreakDown)
+	run(start.Add(time.Second))
+	expect("second tick", 0, 2, 2, Online, BreakDown)
+	run(start.Add(3 * time.Second))
+	expect("fourth tick", 1, 3, 4, Online, Offline)
+	// offline endpoints are still checked and come back with the first successful check
+	atomic.StoreInt32(&healthy, 1)
+	run(start.Add(6 * time.Second))
+	expect("seventh tick", 1, 4, 5, Online, Online)
+}
+
+func TestHopHeaders(t *testing.T) {
+	f := newHopFilter([]byte("keep-alive, X-Upstream-Token"))
+	for _, key := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "x-upstream-token"} {
+		if !f.isHop([]byte(key)) {
+			t.Fatalf("%s not filtered", key)
+		}
+	}
+	for _, key := range []string{"Content-Type", "Set-Cookie", "X-Request-Id"} {
+		if f.isHop([]byte(key)) {
+			t.Fatalf("%s filtered", key)
+		}
+	}
+
+	router := &Router{}
+	if ok, err := router.setAttr(constant.KeepAliveKeyString, []byte("false")); !ok || err != nil || !router.disableKeepAlive {
+		t.Fatalf("unexpected keep-alive: %t, err: %v", router.disableKeepAlive, err)
+	}
+	if _, err := router.setAttr(constant.KeepAliveKeyString, []byte("off")); err == nil {
+		t.Fatal("expected keep-alive error")
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		// no content length, the response is chunked
+		for i := 0; i < 3; i++ {
+			_, _ = w.Write(append(body, '\n'))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	ep := &endpointEntry{name: "a", addr: []byte(strings.TrimPrefix(backend.URL, "http://")), stats: &endpointStats{}}
+	target := &TargetServer{
+		host:    ep.addr,
+		uri:     []byte("/download"),
+		timeout: time.Second,
+		route:   &routeEntry{name: []byte("download"), streaming: true},
+		tried:   []*endpointEntry{ep},
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/download?id=1")
+	ctx.Request.SetBodyString("chunk")
+
+	s := newStreamer(nil)
+	// the slot is taken by Select and given back once the body is sent
+	ep.stats.acquire()
+	s.serve(ctx, target)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || ep.stats.outstanding() != 1 {
+		t.Fatalf("unexpected status: %d, inflight: %d", ctx.Response.StatusCode(), ep.stats.outstanding())
+	}
+	if len(ctx.Response.Header.Peek("X-Hop")) > 0 || string(ctx.Response.Header.ContentType()) != "application/octet-stream" {
+		t.Fatalf("unexpected headers: %s", ctx.Response.Header.String())
+	}
+	if strings.Count(ctx.Response.Header.String(), "Set-Cookie") != 2 {
+		t.Fatalf("unexpected cookies: %s", ctx.Response.Header.String())
+	}
+	// reading the stream releases the endpoint
+	if body := string(ctx.Response.Body()); body != "chunk\nchunk\nchunk\n" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if ep.stats.outstanding() != 0 {
+		t.Fatalf("endpoint not released: %d", ep.stats.outstanding())
+	}
+}
+
+func TestStreamingUpload(t *testing.T) {
+	limit := conf.Conf.Server.MaxRequestBodySize
+	conf.Conf.Server.MaxRequestBodySize = 32 * 1024
+	defer func() {
+		conf.Conf.Server.MaxRequestBodySize = limit
+	}()
+
+	firstChunk := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 4096)
+		n, _ := io.ReadFull(r.Body, buf)
+		if n == len(buf) && r.URL.Query().Get("wait") == "1" {
+			close(firstChunk)
+		}
+		rest, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Query().Get("hang") == "1" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(n + len(rest))))
+	}))
+	defer backend.Close()
+
+	ep := &endpointEntry{name: "a", addr: []byte(strings.TrimPrefix(backend.URL, "http://")), stats: &endpointStats{}}
+	s := newStreamer(nil)
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	server := &fasthttp.Server{
+		MaxRequestBodySize:           conf.Conf.Server.MaxRequestBodySize,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			defer finishRequestBody(ctx)
+			switch string(ctx.Path()) {
+			case "/upload", "/slow":
+				timeout := time.Second
+				if string(ctx.Path()) == "/slow" {
+					timeout = 200 * time.Millisecond
+				}
+				ep.stats.acquire()
+				s.serve(ctx, &TargetServer{
+					host:    ep.addr,
+					uri:     []byte("/upload"),
+					timeout: timeout,
+					route:   &routeEntry{name: []byte("upload"), streaming: true},
+					tried:   []*endpointEntry{ep},
+				})
+			case "/buffered":
+				body, err := bufferedRequestBody(ctx)
+				if err == fasthttp.ErrBodyTooLarge {
+					ctx.SetConnectionClose()
+					ctx.Error("Request Entity Too Large", fasthttp.StatusRequestEntityTooLarge)
+					return
+				}
+				ctx.SetBodyString(strconv.Itoa(len(body)))
+			default:
+				// the body is not read
+				ctx.SetStatusCode(fasthttp.StatusNotFound)
+			}
+		},
+	}
+	go func() {
+		_ = server.Serve(gateway)
+	}()
+	url := "http://" + gateway.Addr().String()
+	post := func(path string, body io.Reader) (int, string) {
+		res, err := http.Post(url+path, "application/octet-stream", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// the upload reaches the endpoint before the client finished sending it
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write(make([]byte, 4096))
+		select {
+		case <-firstChunk:
+			_, _ = pw.Write(make([]byte, 1<<20))
+			_ = pw.Close()
+		case <-time.After(2 * time.Second):
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}()
+	if status, body := post("/upload?wait=1", pr); status != fasthttp.StatusOK || body != strconv.Itoa(4096+1<<20) {
+		t.Fatalf("unexpected upload: %d %s", status, body)
+	}
+	// known length above the limit
+	if status, body := post("/upload", bytes.NewReader(make([]byte, 100000))); status != fasthttp.StatusOK || body != "100000" {
+		t.Fatalf("unexpected upload: %d %s", status, body)
+	}
+	// the router timeout starts once the upload is sent, it only bounds the wait for the response header
+	pr, pw = io.Pipe()
+	go func() {
+		_, _ = pw.Write(make([]byte, 4096))
+		time.Sleep(500 * time.Millisecond)
+		_, _ = pw.Write(make([]byte, 4096))
+		_ = pw.Close()
+	}()
+	if status, body := post("/slow", pr); status != fasthttp.StatusOK || body != "8192" {
+		t.Fatalf("slow upload timed out: %d %s", status, body)
+	}
+	if status, _ := post("/slow?hang=1", bytes.NewReader(make([]byte, 512))); status != fasthttp.StatusGatewayTimeout {
+		t.Fatalf("response header not bounded by the timeout: %d", status)
+	}
+	if ep.stats.outstanding() != 0 {
+		t.Fatalf("endpoint not released: %d", ep.stats.outstanding())
+	}
+
+	// the buffered proxy keeps the limit, chunked bodies included
+	if status, body := post("/buffered", bytes.NewReader(make([]byte, 512))); status != fasthttp.StatusOK || body != "512" {
+		t.Fatalf("unexpected buffered body: %d %s", status, body)
+	}
+	if status, _ := post("/buffered", bytes.NewReader(make([]byte, 40000))); status != fasthttp.StatusRequestEntityTooLarge {
+		t.Fatalf("limit not applied: %d", status)
+	}
+	if status, _ := post("/buffered", ioutil.NopCloser(bytes.NewReader(make([]byte, 40000)))); status != fasthttp.StatusRequestEntityTooLarge {
+		t.Fatalf("limit not applied to chunked body: %d", status)
+	}
+
+	// bodies left unread do not break the next request of the connection, the server only prefetched 8KB
+	conn, err := net.Dial("tcp", gateway.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, path := range []string{"/unread", "/buffered"} {
+		_, _ = conn.Write([]byte("POST " + path + " HTTP/1.1\r\nHost: gw\r\nContent-Length: 20000\r\n\r\n"))
+		_, _ = conn.Write(make([]byte, 20000))
+		res := &fasthttp.Response{}
+		if err := res.Read(br); err != nil {
+			t.Fatal(err)
+		}
+		if res.ConnectionClose() {
+			t.Fatalf("%s: connection closed", path)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req := fasthttp.AcquireRequest()
+				defer fasthttp.ReleaseRequest(req)
+				if err := req.Read(br); err != nil {
+					return
+				}
+				if string(req.URI().Path()) == "/refused" {
+					_, _ = conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 6\r\n\r\ndenied"))
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + string(req.Header.Peek("Sec-WebSocket-Key")) + "\r\n" +
+					"X-Query: " + string(req.URI().QueryString()) + "\r\n\r\n"))
+				// echo the frames
+				_, _ = io.Copy(conn, br)
+			}(conn)
+		}
+	}()
+
+	ep := &endpointEntry{name: "a", addr: []byte(backend.Addr().String()), stats: &endpointStats{}}
+	route := &routeEntry{
+		name:      []byte("chat"),
+		webSocket: &webSocketEntry{idleTimeout: 200 * time.Millisecond, maxConns: 1, conns: new(int64)},
+	}
+	p := newWebSocketProxy(nil)
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	go func() {
+		_ = fasthttp.Serve(gateway, func(ctx *fasthttp.RequestCtx) {
+			if !isWebSocketUpgrade(ctx) {
+				ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+				return
+			}
+			ep.stats.acquire()
+			p.serve(ctx, &TargetServer{
+				host:    ep.addr,
+				uri:     ctx.Path(),
+				timeout: time.Second,
+				route:   route,
+				tried:   []*endpointEntry{ep},
+			})
+		})
+	}()
+
+	handshake := func(path string) (net.Conn, *bufio.Reader, *fasthttp.Response) {
+		conn, err := net.Dial("tcp", gateway.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: gw.example.com\r\nConnection: Upgrade\r\n" +
+			"Upgrade: websocket\r\nSec-WebSocket-Key: key\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		res := &fasthttp.Response{}
+		if err := res.Read(br); err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, res
+	}
+
+	conn, br, res := handshake("/chat?room=1")
+	defer conn.Close()
+	if res.StatusCode() != fasthttp.StatusSwitchingProtocols || string(res.Header.Peek("Sec-WebSocket-Accept")) != "key" {
+		t.Fatalf("unexpected handshake: %s", res.Header.String())
+	}
+	if string(res.Header.Peek("Upgrade")) != "websocket" || string(res.Header.Peek("X-Query")) != "room=1" {
+		t.Fatalf("unexpected handshake: %s", res.Header.String())
+	}
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q, %v", buf, err)
+	}
+
+	// the router allows a single connection, the probe of the half-open endpoint picked for the refused one is
+	// given back
+	atomic.StoreInt64(&ep.stats.ejectedUntil, time.Now().Add(-time.Second).UnixNano())
+	atomic.StoreInt32(&ep.stats.probing, 1)
+	other, _, res := handshake("/chat")
+	other.Close()
+	if res.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("connection limit not applied: %d", res.StatusCode())
+	}
+	if !ep.stats.available(time.Now().UnixNano()) {
+		t.Fatal("probe not given back")
+	}
+	atomic.StoreInt64(&ep.stats.ejectedUntil, 0)
+
+	// the idle connection is closed by the gateway
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("idle connection not closed: %v", err)
+	}
+	if atomic.LoadInt64(route.webSocket.conns) != 0 || ep.stats.outstanding() != 0 {
+		t.Fatalf("connection not released: %d, %d", atomic.LoadInt64(route.webSocket.conns), ep.stats.outstanding())
+	}
+
+	refused, _, res := handshake("/refused")
+	refused.Close()
+	if res.StatusCode() != fasthttp.StatusForbidden || string(res.Body()) != "denied" {
+		t.Fatalf("unexpected response: %d %q", res.StatusCode(), res.Body())
+	}
+	if atomic.LoadInt64(route.webSocket.conns) != 0 || ep.stats.outstanding() != 0 {
+		t.Fatalf("connection not released: %d, %d", atomic.LoadInt64(route.webSocket.conns), ep.stats.outstanding())
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	ep := &endpointEntry{name: "a", addr: []byte(strings.TrimPrefix(backend.URL, "http://")), stats: &endpointStats{}}
+	route := &routeEntry{name: []byte("events")}
+	s := newStreamer(nil)
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	go func() {
+		_ = fasthttp.Serve(gateway, func(ctx *fasthttp.RequestCtx) {
+			target := &TargetServer{
+				host:    ep.addr,
+				uri:     []byte("/events"),
+				timeout: 100 * time.Millisecond,
+				route:   route,
+				tried:   []*endpointEntry{ep},
+			}
+			if !streamed(ctx, target) {
+				ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+				return
+			}
+			ep.stats.acquire()
+			s.serve(ctx, target)
+		})
+	}()
+
+	conn, err := net.Dial("tcp", gateway.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: gw.example.com\r\nAccept: text/event-stream\r\n\r\n"))
+	// the first event arrives while the backend keeps the stream open longer than the timeout
+	time.Sleep(200 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	br := bufio.NewReader(conn)
+	header := &fasthttp.ResponseHeader{}
+	if err := header.Read(br); err != nil {
+		t.Fatal(err)
+	}
+	if header.StatusCode() != fasthttp.StatusOK || header.ContentLength() != -1 {
+		t.Fatalf("unexpected header: %s", header.String())
+	}
+	// chunk size line, event, chunk end
+	var event []string
+	for i := 0; i < 3; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event not flushed: %v", err)
+		}
+		event = append(event, line)
+	}
+	if event[1] != "data: 1\n" {
+		t.Fatalf("unexpected event: %q", event)
+	}
+}
+
+func TestBufferedEventStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	}))
+	defer backend.Close()
+
+	r := newTestTable()
+	r.retry = newRetryPolicy()
+	r.outlier = newOutlierDetector()
+	svr := newTestService(map[string]int{"a": 1})
+	ep, _ := svr.ep.Load("a")
+	ep.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	addTestRouter(t, r, "events", "GET@/events", svr, nil)
+	r.publish()
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	go func() {
+		_ = fasthttp.Serve(gateway, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue("Table", r)
+			ReverseProxyHandler(ctx)
+		})
+	}()
+
+	conn, err := net.Dial("tcp", gateway.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the router is not streaming and the client does not ask for an event stream, the chunked header of the
+	// response switches the proxy to streaming
+	_, _ = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: gw.example.com\r\n\r\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	br := bufio.NewReader(conn)
+	header := &fasthttp.ResponseHeader{}
+	if err := header.Read(br); err != nil {
+		t.Fatal(err)
+	}
+	if header.StatusCode() != fasthttp.StatusOK || header.ContentLength() != -1 {
+		t.Fatalf("unexpected header: %s", header.String())
+	}
+	// chunk size line, event, chunk end
+	var event []string
+	for i := 0; i < 4; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event not flushed: %v", err)
+		}
+		event = append(event, line)
+	}
+	if event[1] != "data: 1\n" || event[3] != "\r\n" {
+		t.Fatalf("unexpected event: %q", event)
+	}
+	stats := r.stats.LoadOrCreate("a")
+	if stats.outstanding() != 1 {
+		t.Fatalf("slot released before the end of the stream: %d", stats.outstanding())
+	}
+	close(release)
+	res := &fasthttp.Response{}
+	header.CopyTo(&res.Header)
+	if err := res.ReadBody(br, 0); err != nil || string(res.Body()) != "data: 2\n\n" {
+		t.Fatalf("unexpected end of stream: %q, err: %v", res.Body(), err)
+	}
+	for i := 0; stats.outstanding() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("slot not released: %d", stats.outstanding())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamScheme(t *testing.T) {
+	if _, err := parseScheme([]byte("ftp")); err == nil {
+		t.Fatal("expected unsupported scheme error")
+	}
+	if _, err := parseUpstreamTLS([]byte(`{"CA": "not a pem"}`)); err == nil {
+		t.Fatal("expected invalid ca error")
+	}
+
+	tlsSvr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer tlsSvr.Close()
+	h2cLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2cSvr := &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(r.Proto + " " + r.Host))
+	}), &http2.Server{})}
+	go h2cSvr.Serve(h2cLn)
+	defer h2cSvr.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSvr.Certificate().Raw})
+	caJson, _ := json.Marshal(map[string]string{"CA": string(ca)})
+	trusted, err := parseUpstreamTLS(caJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svr := newTestService(map[string]int{"a": 1})
+	a, _ := svr.ep.Load("a")
+	call := func(scheme string, opts *upstreamTLS, addr net.Addr) (string, error) {
+		a.port = addr.(*net.TCPAddr).Port
+		a.scheme = scheme
+		a.tls = opts
+		entry := newServiceEntry(svr, newEndpointStatsMap())
+		newConnPoolMap().attach(svr, entry)
+		ep := entry.endpoints[0]
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(res)
+		req.SetRequestURI(ep.uriScheme() + "://" + string(ep.addr) + "/")
+		err := ep.doTimeout(req, res, time.Second)
+		return string(res.Body()), err
+	}
+
+	if body, err := call(httpsScheme, trusted, tlsSvr.Listener.Addr()); err != nil || body != "HTTP/1.1" {
+		t.Fatalf("unexpected https response: %s, err: %v", body, err)
+	}
+	// the certificate of the test server is not trusted by the system roots
+	if _, err := call(httpsScheme, nil, tlsSvr.Listener.Addr()); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+	insecure, _ := parseUpstreamTLS([]byte(`{"InsecureSkipVerify": true}`))
+	if _, err := call(httpsScheme, insecure, tlsSvr.Listener.Addr()); err != nil {
+		t.Fatalf("unexpected https error: %v", err)
+	}
+	if body, err := call(h2cScheme, nil, h2cLn.Addr()); err != nil || !strings.HasPrefix(body, "HTTP/2.0 127.0.0.1:") {
+		t.Fatalf("unexpected h2c response: %s, err: %v", body, err)
+	}
+
+	// http checks follow the scheme of the node
+	host := []byte("127.0.0.1")
+	hc := &HealthCheck{path: []byte("/check"), timeout: 1}
+	if ok, _ := hc.Check(host, tlsSvr.Listener.Addr().(*net.TCPAddr).Port); ok {
+		t.Fatal("expected plain http check of a tls node to fail")
+	}
+	if ok, err := hc.checkEndpoint(host, tlsSvr.Listener.Addr().(*net.TCPAddr).Port, httpsScheme, trusted); !ok || err != nil {
+		t.Fatalf("https node check failed: %v", err)
+	}
+	if ok, err := hc.checkEndpoint(host, h2cLn.Addr().(*net.TCPAddr).Port, h2cScheme, nil); !ok || err != nil {
+		t.Fatalf("h2c node check failed: %v", err)
+	}
+
+	// https checks verify the certificate with the tls options of the node
+	https := &HealthCheck{typ: httpsHealthCheck, path: []byte("/check"), timeout: 1}
+	tlsPort := tlsSvr.Listener.Addr().(*net.TCPAddr).Port
+	if ok, err := https.checkEndpoint(host, tlsPort, httpScheme, trusted); !ok || err != nil {
+		t.Fatalf("https check of a trusted node failed: %v", err)
+	}
+	otherJson, _ := json.Marshal(map[string]string{"CA": string(ca), "ServerName": "order.internal"})
+	other, err := parseUpstreamTLS(otherJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := https.checkEndpoint(host, tlsPort, httpScheme, other); ok {
+		t.Fatal("expected https check to verify the server name of the node")
+	}
+	if ok, err := https.checkEndpoint(host, tlsPort, httpScheme, nil); !ok || err != nil {
+		t.Fatalf("https check without tls options failed: %v", err)
+	}
+
+	// grpc checks of https nodes use tls too
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcSvr := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&tlsSvr.TLS.Certificates[0])))
+	grpc_health_v1.RegisterHealthServer(grpcSvr, health.NewServer())
+	go grpcSvr.Serve(grpcLn)
+	defer grpcSvr.Stop()
+	grpcCheck := &HealthCheck{typ: grpcHealthCheck, timeout: 1}
+	grpcPort := grpcLn.Addr().(*net.TCPAddr).Port
+	if ok, err := grpcCheck.checkEndpoint(host, grpcPort, httpsScheme, trusted); !ok || err != nil {
+		t.Fatalf("grpc check of a trusted node failed: %v", err)
+	}
+	if ok, _ := grpcCheck.checkEndpoint(host, grpcPort, httpsScheme, other); ok {
+		t.Fatal("expected grpc check to verify the server name of the node")
+	}
+	if ok, _ := grpcCheck.checkEndpoint(host, grpcPort, httpScheme, nil); ok {
+		t.Fatal("expected plaintext grpc check of a tls node to fail")
+	}
 }
@@ -0,0 +1,192 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// values of the `Scheme` attribute of nodes, nodes without it are called over http
+	httpScheme  = "http"
+	httpsScheme = "https"
+	// http/2 over cleartext tcp with prior knowledge, e.g. grpc-gateway or h2c servers
+	h2cScheme = "h2c"
+
+	h2cDialTimeout = 5 * time.Second
+)
+
+var (
+	// client of the h2c nodes, the requests to the same node are multiplexed on a single connection
+	h2cClient = &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, h2cDialTimeout)
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// upstreamTLS are the tls options of https nodes, stored in etcd as a json object under `/Node/Node-x/TLS`, e.g.
+// `{"CA": "-----BEGIN CERTIFICATE-----\n...", "ServerName": "order.internal"}`. CA is a pem bundle replacing the
+// system roots, ServerName is verified instead of the node host, InsecureSkipVerify disables the verification and
+// is only meant for development.
+type upstreamTLS struct {
+	CA                 string `json:"CA"`
+	ServerName         string `json:"ServerName"`
+	InsecureSkipVerify bool   `json:"InsecureSkipVerify"`
+
+	// attribute value, the pools compare it to know whether the options changed
+	raw    string
+	config *tls.Config
+}
+
+// parseScheme parses the `Scheme` attribute of nodes: `http`, `https` or `h2c`
+func parseScheme(value []byte) (string, error) {
+	scheme := strings.ToLower(strings.TrimSpace(string(value)))
+	switch scheme {
+	case httpScheme, httpsScheme, h2cScheme:
+		return scheme, nil
+	}
+	return "", errors.NewFormat(200, fmt.Sprintf("unsupported node scheme: %s", string(value)))
+}
+
+func parseUpstreamTLS(value []byte) (*upstreamTLS, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	opts := &upstreamTLS{raw: string(value)}
+	if err := json.Unmarshal(value, opts); err != nil {
+		return nil, err
+	}
+	opts.config = &tls.Config{ServerName: opts.ServerName, InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(opts.CA)) {
+			return nil, errors.NewFormat(200, "invalid node tls ca bundle")
+		}
+		opts.config.RootCAs = pool
+	}
+	return opts, nil
+}
+
+// tlsConfig returns the client config of the options, nil verifies the node host against the system roots
+func (t *upstreamTLS) tlsConfig() *tls.Config {
+	if t == nil {
+		return nil
+	}
+	return t.config
+}
+
+func (t *upstreamTLS) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.raw
+}
+
+// uriScheme is the scheme of the upstream uri, h2c nodes are addressed with http
+func (e *endpointEntry) uriScheme() string {
+	if e.scheme == httpsScheme {
+		return httpsScheme
+	}
+	return httpScheme
+}
+
+// setAttr parses an optional attribute of the endpoint, false is returned for attributes which are not optional
+func (e *Endpoint) setAttr(attr string, value []byte) (bool, error) {
+	var err error
+	switch attr {
+	case constant.SchemeKeyString:
+		e.scheme, err = parseScheme(value)
+	case constant.TLSKeyString:
+		e.tls, err = parseUpstreamTLS(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// copyAttrs replaces the optional attributes of the endpoint with the ones of another
+func (e *Endpoint) copyAttrs(another *Endpoint) {
+	e.scheme = another.scheme
+	e.tls = another.tls
+}
+
+// doH2C sends the request to the h2c node at addr and reads the whole response, like the fasthttp clients
+func doH2C(addr string, req *fasthttp.Request, res *fasthttp.Response, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var body io.Reader
+	if len(req.Body()) > 0 {
+		body = bytes.NewReader(req.Body())
+	}
+	hreq, err := http.NewRequest(string(req.Header.Method()), "http://"+addr+string(req.URI().RequestURI()), body)
+	if err != nil {
+		return err
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Host = string(req.Host())
+	hop := newHopFilter(req.Header.Peek("Connection"))
+	req.Header.VisitAll(func(key, value []byte) {
+		if hop.isHop(key) || bytes.Equal(key, constant.StrHost) || bytes.EqualFold(key, []byte("Content-Length")) {
+			return
+		}
+		hreq.Header.Add(string(key), string(value))
+	})
+
+	hres, err := h2cClient.Do(hreq)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	defer hres.Body.Close()
+	resBody, err := ioutil.ReadAll(hres.Body)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	res.Reset()
+	res.SetStatusCode(hres.StatusCode)
+	for key, values := range hres.Header {
+		switch key {
+		case "Content-Length":
+			// set along with the body
+		case "Content-Type":
+			res.Header.SetContentType(values[0])
+		case "Server":
+			res.Header.SetServer(values[0])
+		case "Set-Cookie":
+			for _, value := range values {
+				res.Header.SetCanonical([]byte(key), []byte(value))
+			}
+		default:
+			for _, value := range values {
+				res.Header.Add(key, value)
+			}
+		}
+	}
+	res.SetBody(resBody)
+	return nil
+}
@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// weights are scaled while ramping up, so that small weights can still be reduced
+	slowStartScale = 100
+	// share of its full weight an endpoint starts with
+	slowStartMinFactor = 0.1
+)
+
+// markOnline records when the endpoints came online, it is called by publish() before the service entries are
+// built. Endpoints already online when the gateway starts are not ramped up.
+func (r *Table) markOnline(first bool) {
+	now := time.Now().UnixNano()
+	if first {
+		// long ago
+		now = 1
+	}
+	r.endpointTable.Range(func(key EndpointNameString, value *Endpoint) bool {
+		stats := r.stats.LoadOrCreate(key)
+		if value.status != Online {
+			atomic.StoreInt64(&stats.onlineSince, 0)
+		} else {
+			atomic.CompareAndSwapInt64(&stats.onlineSince, 0, now)
+		}
+		return false
+	})
+}
+
+// effectiveWeight returns the scaled weight of the endpoint, it grows linearly from slowStartMinFactor to the full
+// weight during the slow start window of the service after the endpoint came online
+func (e *endpointEntry) effectiveWeight(now int64) int {
+	weight := e.weight * slowStartScale
+	if weight == 0 || e.slowStart <= 0 || e.stats == nil {
+		return weight
+	}
+	since := atomic.LoadInt64(&e.stats.onlineSince)
+	elapsed := now - since
+	if since == 0 || elapsed >= int64(e.slowStart) {
+		return weight
+	}
+	factor := float64(elapsed) / float64(e.slowStart)
+	if factor < slowStartMinFactor {
+		factor = slowStartMinFactor
+	}
+	if ramped := int(float64(weight) * factor); ramped > 0 {
+		return ramped
+	}
+	return 1
+}
+
+// warming reports whether an endpoint of the service is still ramping up
+func (s *serviceEntry) warming(now int64) bool {
+	return s.warmUntil > 0 && now < s.warmUntil
+}
@@ -0,0 +1,250 @@
+package routing
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// snapshot is an immutable view of the online part of the routing table. It is built by the event goroutine
+// after every watch event or health check round and published through an atomic pointer, the request path only
+// reads the current snapshot and never takes any table lock.
+type snapshot struct {
+	// routes without host restriction
+	tree *routeTree
+	// routes bound to an exact host
+	hosts map[string]*routeTree
+	// routes bound to a wildcard host, longest suffix first
+	wildcardHosts []*hostTree
+	// sorted http methods of all routes
+	methods []string
+}
+
+type hostTree struct {
+	pattern string
+	tree    *routeTree
+}
+
+// routeEntry is the read-only copy of an online Router
+type routeEntry struct {
+	name        []byte
+	host        string
+	predicates  []*predicate
+	frontend    [][]byte
+	constraints []*regexp.Regexp
+	backend     [][]byte
+	service     *serviceEntry
+	split       *splitEntry
+	mirror      *mirrorEntry
+	webSocket   *webSocketEntry
+	timeout     time.Duration
+
+	maxAttempts        int
+	retryNonIdempotent bool
+	disableKeepAlive   bool
+	streaming          bool
+}
+
+// serviceEntry is the read-only copy of a Service, it only holds the endpoints which were online when the
+// snapshot was built and have a positive weight
+type serviceEntry struct {
+	name      []byte
+	methods   [][]byte
+	endpoints []*endpointEntry
+
+	// weighted is set when the endpoints have different weights, see next()
+	weighted bool
+	// end of the slow start of the latest endpoint in unix nanoseconds
+	warmUntil int64
+	// round-robin state, shared with the entries of the service in the other snapshots
+	balance *serviceBalance
+
+	balancer balancer
+}
+
+type endpointEntry struct {
+	name EndpointNameString
+	// host:port of the endpoint
+	addr   []byte
+	weight int
+	// slow start window of the service
+	slowStart time.Duration
+	// protocol and tls options of the node
+	scheme string
+	tls    *upstreamTLS
+	// client of the connection pool of the endpoint, see connPoolMap
+	client *fasthttp.HostClient
+	// shared with the other snapshots
+	stats *endpointStats
+}
+
+func (r *Table) loadSnapshot() *snapshot {
+	if s, ok := r.current.Load().(*snapshot); ok {
+		return s
+	}
+	return nil
+}
+
+// publish builds a new snapshot from the mutable tables and swaps it in. It must only be called from the
+// goroutine which modifies the tables (initialisation and the event loop).
+func (r *Table) publish() {
+	r.markOnline(r.loadSnapshot() == nil)
+
+	services := make(map[*Service]*serviceEntry)
+	routes := make(map[string][]*routeEntry)
+	methods := make(map[string]bool)
+
+	entry := func(s *Service) *serviceEntry {
+		svr, ok := services[s]
+		if !ok {
+			svr = newServiceEntry(s, r.stats)
+			if r.balances != nil {
+				svr.balance = r.balances.LoadOrCreate(s.nameString)
+				svr.balance.retain(svr.endpoints)
+			}
+			if r.pools != nil {
+				r.pools.attach(s, svr)
+			}
+			services[s] = svr
+		}
+		return svr
+	}
+	resolve := func(name string) *serviceEntry {
+		if s, ok := r.serviceTable.Load(ServiceNameString(name)); ok {
+			return entry(s)
+		}
+		return nil
+	}
+
+	r.onlineTable.Range(func(key *FrontendApi, value *Router) bool {
+		if value.status != Online || value.service == nil || value.frontendApi == nil || value.backendApi == nil {
+			return false
+		}
+		host := string(value.host)
+		routes[host] = append(routes[host], &routeEntry{
+			name:        value.name,
+			host:        host,
+			predicates:  value.predicates,
+			frontend:    value.frontendApi.pattern,
+			constraints: value.frontendApi.constraints,
+			backend:     value.backendApi.pattern,
+			service:     entry(value.service),
+			split:       newSplitEntry(value.split, resolve),
+			mirror:      newMirrorEntry(value.mirror, resolve),
+			webSocket:   newWebSocketEntry(value),
+			timeout:     upstreamTimeout(value),
+
+			maxAttempts:        value.maxAttempts,
+			retryNonIdempotent: value.retryNonIdempotent,
+			disableKeepAlive:   value.disableKeepAlive,
+			streaming:          value.streaming,
+		})
+		methods[routeMethod(value.frontendApi.pattern)] = true
+		return false
+	})
+
+	snap := &snapshot{
+		tree:  newRouteTree(routes[""]),
+		hosts: make(map[string]*routeTree),
+	}
+	for host, entries := range routes {
+		if host == "" {
+			continue
+		}
+		if strings.HasPrefix(host, wildcardHostPrefix) {
+			snap.wildcardHosts = append(snap.wildcardHosts, &hostTree{pattern: host, tree: newRouteTree(entries)})
+		} else {
+			snap.hosts[host] = newRouteTree(entries)
+		}
+	}
+	for method := range methods {
+		snap.methods = append(snap.methods, method)
+	}
+	sort.Strings(snap.methods)
+	sort.Slice(snap.wildcardHosts, func(i, j int) bool {
+		if len(snap.wildcardHosts[i].pattern) != len(snap.wildcardHosts[j].pattern) {
+			return len(snap.wildcardHosts[i].pattern) > len(snap.wildcardHosts[j].pattern)
+		}
+		return snap.wildcardHosts[i].pattern < snap.wildcardHosts[j].pattern
+	})
+	r.current.Store(snap)
+
+	r.stats.Retain(func(key EndpointNameString) bool {
+		_, ok := r.endpointTable.Load(key)
+		return ok
+	})
+	if r.balances != nil {
+		r.balances.Retain(func(key ServiceNameString) bool {
+			_, ok := r.serviceTable.Load(key)
+			return ok
+		})
+	}
+	if r.pools != nil {
+		r.pools.Retain(func(key EndpointNameString) bool {
+			_, ok := r.endpointTable.Load(key)
+			return ok
+		})
+	}
+}
+
+// lookup tries the routes bound to the exact host first, then the wildcard hosts from the most specific one,
+// and finally the routes without host restriction
+func (s *snapshot) lookup(host string, input [][]byte, accept func(route *routeEntry) bool) *routeEntry {
+	if tree, ok := s.hosts[host]; ok {
+		if route := tree.lookup(input, accept); route != nil {
+			return route
+		}
+	}
+	for _, wildcard := range s.wildcardHosts {
+		if hostMatch(wildcard.pattern, host) {
+			if route := wildcard.tree.lookup(input, accept); route != nil {
+				return route
+			}
+		}
+	}
+	return s.tree.lookup(input, accept)
+}
+
+func newServiceEntry(s *Service, stats *endpointStatsMap) *serviceEntry {
+	entry := &serviceEntry{name: s.name, methods: s.acceptHttpMethod, balance: newServiceBalance()}
+	if s.ep == nil {
+		entry.balancer = newBalancer(s, entry)
+		return entry
+	}
+	online, _ := s.checkEndpointStatus(Online)
+	sort.Slice(online, func(i, j int) bool {
+		return online[i].nameString < online[j].nameString
+	})
+	for _, ep := range online {
+		if ep.weight <= 0 {
+			// registered but receives no traffic
+			continue
+		}
+		epEntry := &endpointEntry{
+			name:      ep.nameString,
+			addr:      bytes.Join([][]byte{ep.host, []byte(strconv.FormatInt(int64(ep.port), 10))}, []byte(":")),
+			weight:    ep.weight,
+			slowStart: s.slowStart,
+			scheme:    ep.scheme,
+			tls:       ep.tls,
+			stats:     stats.LoadOrCreate(ep.nameString),
+		}
+		entry.endpoints = append(entry.endpoints, epEntry)
+		if ep.weight != entry.endpoints[0].weight {
+			entry.weighted = true
+		}
+		if since := atomic.LoadInt64(&epEntry.stats.onlineSince); since > 0 && s.slowStart > 0 {
+			if until := since + int64(s.slowStart); until > entry.warmUntil {
+				entry.warmUntil = until
+			}
+		}
+	}
+	// the balancer is built last, it may precompute state from the endpoints
+	entry.balancer = newBalancer(s, entry)
+	return entry
+}
@@ -0,0 +1,155 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/valyala/fasthttp"
+	"math/rand"
+	"strings"
+)
+
+const (
+	// prefixes of the `Override` of a traffic split, the request value names the service to use
+	splitOverrideHeader = "header:"
+	splitOverrideCookie = "cookie:"
+)
+
+// trafficSplit spreads the requests of a router over several services, e.g. for canary releases. It is stored in
+// etcd as a json object under `/Router/Router-x/Split`, e.g.
+// `{"Services": [{"Service": "order-v1", "Weight": 95}, {"Service": "order-v2", "Weight": 5}], "Override": "header:X-Canary"}`.
+// A request carrying the override header or cookie is sent to the service it names, whatever the weights are.
+// The `Service` attribute of the router stays the default when none of the split services is available.
+type trafficSplit struct {
+	Services []*splitService `json:"Services"`
+	Override string          `json:"Override"`
+}
+
+type splitService struct {
+	Service string `json:"Service"`
+	Weight  int    `json:"Weight"`
+}
+
+// splitEntry is the read-only copy of a trafficSplit, it only holds the services with online endpoints
+type splitEntry struct {
+	services []*serviceEntry
+	// cumulative weights of the services
+	bounds   []int
+	override string
+}
+
+func parseTrafficSplit(value []byte) (*trafficSplit, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	split := &trafficSplit{}
+	if err := json.Unmarshal(value, split); err != nil {
+		return nil, err
+	}
+	if len(split.Services) == 0 {
+		return nil, errors.NewFormat(200, "traffic split lack of services")
+	}
+	seen := make(map[string]bool)
+	for _, s := range split.Services {
+		if s.Service == "" {
+			return nil, errors.NewFormat(200, "traffic split lack of service name")
+		}
+		if s.Weight < 0 {
+			return nil, errors.NewFormat(200, fmt.Sprintf("invalid traffic split weight: %d", s.Weight))
+		}
+		if seen[s.Service] {
+			return nil, errors.NewFormat(200, fmt.Sprintf("duplicated traffic split service: %s", s.Service))
+		}
+		seen[s.Service] = true
+	}
+	if split.Override != "" {
+		override := strings.TrimSpace(split.Override)
+		valid := false
+		for _, prefix := range []string{splitOverrideHeader, splitOverrideCookie} {
+			if strings.HasPrefix(strings.ToLower(override), prefix) && len(override) > len(prefix) {
+				split.Override = prefix + override[len(prefix):]
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, errors.NewFormat(200, fmt.Sprintf("invalid traffic split override: %s", split.Override))
+		}
+	}
+	return split, nil
+}
+
+// newSplitEntry resolves the services of the split, services without online endpoints are left out so their share
+// goes to the others. Nil is returned when no service is left.
+func newSplitEntry(split *trafficSplit, resolve func(name string) *serviceEntry) *splitEntry {
+	if split == nil {
+		return nil
+	}
+	entry := &splitEntry{override: split.Override}
+	total := 0
+	for _, s := range split.Services {
+		svr := resolve(s.Service)
+		if svr == nil || len(svr.endpoints) == 0 {
+			continue
+		}
+		total += s.Weight
+		entry.services = append(entry.services, svr)
+		entry.bounds = append(entry.bounds, total)
+	}
+	if len(entry.services) == 0 {
+		return nil
+	}
+	return entry
+}
+
+// selectService returns the service a request of the route is sent to. The route was matched with the methods of
+// its own service, a split service which does not accept the method of the request leaves it to that service.
+func (e *routeEntry) selectService(ctx *fasthttp.RequestCtx) *serviceEntry {
+	svr := e.splitService(ctx)
+	if ctx != nil && svr != e.service && !svr.acceptMethod(ctx.Method()) {
+		return e.service
+	}
+	return svr
+}
+
+func (e *routeEntry) splitService(ctx *fasthttp.RequestCtx) *serviceEntry {
+	if e.split == nil {
+		return e.service
+	}
+	if svr := e.split.forced(ctx); svr != nil {
+		return svr
+	}
+	total := e.split.bounds[len(e.split.bounds)-1]
+	if total <= 0 {
+		// only reachable with the override
+		return e.service
+	}
+	n := rand.Intn(total)
+	for i, bound := range e.split.bounds {
+		if n < bound {
+			return e.split.services[i]
+		}
+	}
+	return e.service
+}
+
+// forced returns the service named by the override header or cookie of the request
+func (s *splitEntry) forced(ctx *fasthttp.RequestCtx) *serviceEntry {
+	var name []byte
+	switch {
+	case s.override == "" || ctx == nil:
+		return nil
+	case strings.HasPrefix(s.override, splitOverrideHeader):
+		name = ctx.Request.Header.Peek(s.override[len(splitOverrideHeader):])
+	case strings.HasPrefix(s.override, splitOverrideCookie):
+		name = ctx.Request.Header.Cookie(s.override[len(splitOverrideCookie):])
+	}
+	if len(name) == 0 {
+		return nil
+	}
+	for _, svr := range s.services {
+		if string(svr.name) == string(name) {
+			return svr
+		}
+	}
+	return nil
+}
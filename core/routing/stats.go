@@ -0,0 +1,160 @@
+package routing
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// endpointStats holds the runtime state of an endpoint which must survive snapshot rebuilds, it is shared by all
+// snapshots and updated by the request path with atomic operations
+type endpointStats struct {
+	// requests in flight, must be the first field to keep 64-bit alignment for atomic operations
+	inflight int64
+
+	// failures in a row and the calls of the current window, see outlierDetector
+	consecutive int64
+	requests    int64
+	failures    int64
+	windowStart int64
+	// ejections in a row and the end of the current one in unix nanoseconds, 0 when the endpoint is not ejected
+	ejections    int64
+	ejectedUntil int64
+	// when the endpoint came online in unix nanoseconds, 0 while it is not online, see effectiveWeight()
+	onlineSince int64
+	// set while the probe of a half-open endpoint is in flight
+	probing int32
+}
+
+func (s *endpointStats) acquire() {
+	atomic.AddInt64(&s.inflight, 1)
+}
+
+func (s *endpointStats) release() {
+	atomic.AddInt64(&s.inflight, -1)
+}
+
+func (s *endpointStats) outstanding() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// endpointStatsMap is the registry of endpoint stats, entries are created and removed by publish()
+type endpointStatsMap struct {
+	sync.RWMutex
+	internal map[EndpointNameString]*endpointStats
+}
+
+func newEndpointStatsMap() *endpointStatsMap {
+	return &endpointStatsMap{
+		internal: make(map[EndpointNameString]*endpointStats),
+	}
+}
+
+func (m *endpointStatsMap) Load(key EndpointNameString) (value *endpointStats, ok bool) {
+	m.RLock()
+	value, ok = m.internal[key]
+	m.RUnlock()
+	return value, ok
+}
+
+// LoadOrCreate returns the stats of the endpoint, creating them if necessary
+func (m *endpointStatsMap) LoadOrCreate(key EndpointNameString) *endpointStats {
+	if value, ok := m.Load(key); ok {
+		return value
+	}
+	m.Lock()
+	defer m.Unlock()
+	value, ok := m.internal[key]
+	if !ok {
+		value = &endpointStats{}
+		m.internal[key] = value
+	}
+	return value
+}
+
+// Retain removes the stats of the endpoints for which keep returns false
+func (m *endpointStatsMap) Retain(keep func(key EndpointNameString) bool) {
+	m.Lock()
+	for k := range m.internal {
+		if !keep(k) {
+			delete(m.internal, k)
+		}
+	}
+	m.Unlock()
+}
+
+// serviceBalance holds the round-robin state of a service which must survive snapshot rebuilds, a rebuilt service
+// entry would otherwise restart at its first endpoint and starve the light endpoints when the snapshots are published
+// often. It is shared by all snapshots, see serviceEntry.next()
+type serviceBalance struct {
+	// round-robin cursor, must be the first field to keep 64-bit alignment for atomic operations
+	cursor uint64
+
+	// guards current
+	mu sync.Mutex
+	// current weights of smooth weighted round-robin, keyed by endpoint
+	current map[EndpointNameString]int
+}
+
+func newServiceBalance() *serviceBalance {
+	return &serviceBalance{current: make(map[EndpointNameString]int)}
+}
+
+// retain drops the current weights of the endpoints which are no longer balanced
+func (b *serviceBalance) retain(endpoints []*endpointEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range b.current {
+		found := false
+		for _, ep := range endpoints {
+			if ep.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(b.current, name)
+		}
+	}
+}
+
+// serviceBalanceMap is the registry of the balancer states of the services, entries are created and removed by
+// publish()
+type serviceBalanceMap struct {
+	sync.RWMutex
+	internal map[ServiceNameString]*serviceBalance
+}
+
+func newServiceBalanceMap() *serviceBalanceMap {
+	return &serviceBalanceMap{
+		internal: make(map[ServiceNameString]*serviceBalance),
+	}
+}
+
+// LoadOrCreate returns the balancer state of the service, creating it if necessary
+func (m *serviceBalanceMap) LoadOrCreate(key ServiceNameString) *serviceBalance {
+	m.RLock()
+	value, ok := m.internal[key]
+	m.RUnlock()
+	if ok {
+		return value
+	}
+	m.Lock()
+	defer m.Unlock()
+	value, ok = m.internal[key]
+	if !ok {
+		value = newServiceBalance()
+		m.internal[key] = value
+	}
+	return value
+}
+
+// Retain removes the balancer states of the services for which keep returns false
+func (m *serviceBalanceMap) Retain(keep func(key ServiceNameString) bool) {
+	m.Lock()
+	for k := range m.internal {
+		if !keep(k) {
+			delete(m.internal, k)
+		}
+	}
+	m.Unlock()
+}
@@ -0,0 +1,427 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"github.com/hhjpin/goutils/logger"
+	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamDialTimeout = 5 * time.Second
+
+	eventStreamContentType = "text/event-stream"
+)
+
+// streamer proxies the routers in streaming mode (`Streaming=true`) and the Server-Sent Events requests of any
+// router. The fasthttp clients bound the whole response by the router timeout, streaming calls use a net/http
+// transport instead and pipe the response body to the client while it is received, every chunk read from the
+// endpoint is flushed to the client at once. The servers stream the request bodies (see main.go), the upload is
+// piped to the endpoint while it is received from the client and is not bounded by `Server.MaxRequestBodySize`.
+// Streaming calls are neither retried nor mirrored, and the router timeout only applies from the end of the upload
+// until the response header is received.
+type streamer struct {
+	client  *http.Client
+	outlier *outlierDetector
+
+	maxConns int
+	idle     time.Duration
+	// clients of the https nodes having tls options, keyed by endpoint
+	mu         sync.Mutex
+	tlsClients map[EndpointNameString]*streamTLSClient
+}
+
+type streamTLSClient struct {
+	tls    string
+	client *http.Client
+}
+
+// streamBody is the upstream response body handed to fasthttp, it is closed by fasthttp once written to the
+// client or when the client went away
+type streamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// streamRequestBody hands the request body stream of the server to the transport. The stream reads the client
+// connection which the server reuses once the handler returns, so the handler waits for the transport to close the
+// body, the transports close it once it is sent or the call failed.
+type streamRequestBody struct {
+	r      io.Reader
+	eof    bool
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newStreamRequestBody(r io.Reader) *streamRequestBody {
+	return &streamRequestBody{r: r, closed: make(chan struct{})}
+}
+
+func (b *streamRequestBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *streamRequestBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
+
+// finish waits for the transport to release the body, the connection of the client is closed when the body was
+// not read to the end, the rest would be parsed as the next request
+func (b *streamRequestBody) finish(ctx *fasthttp.RequestCtx) {
+	<-b.closed
+	if b.eof {
+		ctx.Request.SetBodyRaw(nil)
+	} else {
+		ctx.SetConnectionClose()
+	}
+}
+
+// sentBody tells when the transport is done with the request body, the transports close the bodies once they are
+// sent or the call failed
+type sentBody struct {
+	io.Reader
+	once sync.Once
+	sent func()
+}
+
+func (b *sentBody) Close() error {
+	var err error
+	if c, ok := b.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+	b.once.Do(b.sent)
+	return err
+}
+
+// headerTimer cancels a streaming call when the response header is not received within the router timeout. It is
+// started once the request body is sent, an upload is not bounded by the router timeout.
+type headerTimer struct {
+	timeout time.Duration
+	cancel  func()
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func (t *headerTimer) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer == nil && !t.stopped {
+		t.timer = time.AfterFunc(t.timeout, t.cancel)
+	}
+}
+
+// stop stops the timer, it reports whether the call was canceled
+func (t *headerTimer) stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	return t.timer != nil && !t.timer.Stop()
+}
+
+// maxRequestBodySize is the body size the buffered proxy accepts, like the server without body streaming
+func maxRequestBodySize() int {
+	if size := conf.Conf.Server.MaxRequestBodySize; size > 0 {
+		return size
+	}
+	return fasthttp.DefaultMaxRequestBodySize
+}
+
+// bufferedRequestBody reads the whole request body for the buffered proxy. The servers only prefetch the bodies,
+// the ones larger than `Server.MaxRequestBodySize` are refused with ErrBodyTooLarge and must use a streaming
+// router.
+func bufferedRequestBody(ctx *fasthttp.RequestCtx) ([]byte, error) {
+	stream := ctx.RequestBodyStream()
+	if stream == nil {
+		return ctx.Request.Body(), nil
+	}
+	limit := maxRequestBodySize()
+	contentLength := ctx.Request.Header.ContentLength()
+	if contentLength > limit {
+		return nil, fasthttp.ErrBodyTooLarge
+	} else if contentLength >= 0 {
+		return ctx.Request.Body(), nil
+	}
+	// chunked
+	body, err := ioutil.ReadAll(io.LimitReader(stream, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, fasthttp.ErrBodyTooLarge
+	}
+	ctx.Request.SetBodyRaw(body)
+	return body, nil
+}
+
+// finishRequestBody is called once the request is handled, the bodies left unread by the handler are read when
+// they fit in `Server.MaxRequestBodySize` to keep the connection alive, the connection is closed otherwise
+func finishRequestBody(ctx *fasthttp.RequestCtx) {
+	if ctx.RequestBodyStream() == nil || ctx.Hijacked() {
+		return
+	}
+	if contentLength := ctx.Request.Header.ContentLength(); contentLength >= 0 && contentLength <= maxRequestBodySize() {
+		_ = ctx.Request.Body()
+	} else {
+		ctx.SetConnectionClose()
+	}
+}
+
+// streamed reports whether the request is proxied by the streamer, the choice is made before the upstream call.
+// EventSource clients always accept `text/event-stream`. The chunked responses of the other requests, event streams
+// included, are streamed by the buffered proxy once their header shows it, see streamedResponse.
+func streamed(ctx *fasthttp.RequestCtx, target *TargetServer) bool {
+	if target.route != nil && target.route.streaming {
+		return true
+	}
+	return bytes.Contains(ctx.Request.Header.Peek("Accept"), []byte(eventStreamContentType))
+}
+
+// streamedResponse reports whether the response of the buffered proxy is sent while it is received. Only chunked
+// bodies are left unread by the fasthttp client, the other ones are read along with the header. The router timeout
+// still bounds the whole response, long-lived event streams need the streaming mode or an EventSource client.
+func streamedResponse(res *fasthttp.Response) bool {
+	return res.BodyStream() != nil && res.Header.ContentLength() == -1
+}
+
+// responseStream is the chunked body of a response of the buffered proxy. The upstream connection goes back to its
+// pool when the body was read to the end, it is closed otherwise, the rest would be read as the next response.
+type responseStream struct {
+	res *fasthttp.Response
+	eof bool
+}
+
+func (s *responseStream) Read(p []byte) (int, error) {
+	n, err := s.res.BodyStream().Read(p)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+func (s *responseStream) Close() error {
+	if !s.eof {
+		s.res.SetConnectionClose()
+	}
+	return s.res.CloseBodyStream()
+}
+
+// closeResponseStream drops the unread body of a response which is not sent to the client, e.g. before a retry
+func closeResponseStream(res *fasthttp.Response) {
+	if streamedResponse(res) {
+		_ = (&responseStream{res: res}).Close()
+	}
+}
+
+// warnUnstreamed reports the event-stream responses buffered by the proxy, the router should be in streaming mode
+func warnUnstreamed(target *TargetServer, res *fasthttp.Response) {
+	if bytes.HasPrefix(res.Header.ContentType(), []byte(eventStreamContentType)) {
+		logger.Warnf("event stream buffered on router %s, enable the streaming mode of the router",
+			string(target.route.name))
+	}
+}
+
+func newStreamer(outlier *outlierDetector) *streamer {
+	cfg := conf.Conf.Client
+	maxConns := cfg.MaxConnsPerHost
+	if maxConns <= 0 {
+		maxConns = fasthttp.DefaultMaxConnsPerHost
+	}
+	idle := time.Duration(cfg.MaxIdleConnDuration) * time.Second
+	if idle <= 0 {
+		idle = fasthttp.DefaultMaxIdleConnDuration
+	}
+	s := &streamer{
+		outlier:    outlier,
+		maxConns:   maxConns,
+		idle:       idle,
+		tlsClients: make(map[EndpointNameString]*streamTLSClient),
+	}
+	s.client = s.newClient(nil)
+	return s
+}
+
+func (s *streamer) newClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: streamDialTimeout}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			MaxConnsPerHost:     s.maxConns,
+			MaxIdleConnsPerHost: s.maxConns,
+			IdleConnTimeout:     s.idle,
+			// the encoding of the backend is passed through untouched
+			DisableCompression: true,
+		},
+		// redirects are answered to the client like in buffered mode
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// clientOf returns the client matching the scheme of the endpoint. Https nodes with tls options get their own
+// client, it is replaced when the options change.
+func (s *streamer) clientOf(ep *endpointEntry) *http.Client {
+	switch {
+	case ep.scheme == h2cScheme:
+		return h2cClient
+	case ep.scheme != httpsScheme || ep.tls == nil:
+		return s.client
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.tlsClients[ep.name]
+	if !ok || c.tls != ep.tls.String() {
+		if ok {
+			c.client.CloseIdleConnections()
+		}
+		c = &streamTLSClient{tls: ep.tls.String(), client: s.newClient(ep.tls.tlsConfig())}
+		s.tlsClients[ep.name] = c
+	}
+	return c.client
+}
+
+// serve proxies the request to the endpoint of the target and streams the response back, the in-flight slot taken
+// by Select is given back once the response body is sent
+func (s *streamer) serve(ctx *fasthttp.RequestCtx, target *TargetServer) {
+	ep := target.endpoint()
+	url := ep.uriScheme() + "://" + string(target.host) + string(target.uri)
+	if queryString := ctx.QueryArgs().QueryString(); len(queryString) > 0 {
+		url += "?" + string(queryString)
+	}
+	var body io.Reader
+	var reqBody *streamRequestBody
+	reqLength := int64(ctx.Request.Header.ContentLength())
+	if stream := ctx.RequestBodyStream(); stream != nil {
+		if reqLength != 0 {
+			reqBody = newStreamRequestBody(stream)
+			body = reqBody
+		}
+	} else if buf := ctx.Request.Body(); len(buf) > 0 {
+		body = bytes.NewReader(buf)
+		reqLength = int64(len(buf))
+	}
+	callCtx, cancel := context.WithCancel(context.Background())
+	timer := &headerTimer{timeout: target.timeout, cancel: cancel}
+	if body == nil {
+		reqLength = 0
+		timer.start()
+	} else {
+		if reqLength < 0 {
+			// chunked
+			reqLength = -1
+		}
+		body = &sentBody{Reader: body, sent: timer.start}
+	}
+	req, err := http.NewRequest(string(ctx.Method()), url, body)
+	if err != nil {
+		cancel()
+		ep.stats.unclaim()
+		ep.stats.release()
+		logger.Error(err)
+		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+		return
+	}
+	req = req.WithContext(callCtx)
+	req.ContentLength = reqLength
+	reqHop := newHopFilter(ctx.Request.Header.Peek("Connection"))
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		if reqHop.isHop(key) || bytes.EqualFold(key, []byte("Content-Length")) {
+			// pass
+		} else if bytes.EqualFold(key, []byte("Host")) {
+			req.Header.Add("X-Forwarded-Host", string(value))
+		} else {
+			req.Header.Add(string(key), string(value))
+		}
+	})
+
+	res, err := s.clientOf(ep).Do(req)
+	timedOut := timer.stop()
+	if err == nil && timedOut {
+		// the call was canceled right after the header arrived
+		_ = res.Body.Close()
+		err = fasthttp.ErrTimeout
+	}
+	if err != nil {
+		ep.stats.release()
+		cancel()
+		if reqBody != nil {
+			reqBody.finish(ctx)
+		}
+		if timedOut {
+			err = fasthttp.ErrTimeout
+		}
+		if s.outlier != nil {
+			s.outlier.report(ep, err, 0)
+		}
+		if err == fasthttp.ErrTimeout {
+			logger.Warnf("upstream timeout after %s: %s%s", target.timeout, string(target.host), string(target.uri))
+			ctx.Error("Gateway Timeout", fasthttp.StatusGatewayTimeout)
+		} else {
+			logger.Error(err)
+			ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+	if s.outlier != nil {
+		s.outlier.report(ep, nil, res.StatusCode)
+	}
+	if reqBody != nil {
+		// the endpoint may answer before the end of the upload, it is still sent
+		reqBody.finish(ctx)
+	}
+
+	resHop := newHopFilter([]byte(strings.Join(res.Header["Connection"], ",")))
+	for key, values := range res.Header {
+		switch {
+		case resHop.isHop([]byte(key)):
+		case key == "Content-Length" || key == "Date":
+			// managed by the server
+		case key == "Content-Type":
+			ctx.Response.Header.SetContentType(values[0])
+		case key == "Server":
+			ctx.Response.Header.SetServer(values[0])
+		default:
+			for _, value := range values {
+				ctx.Response.Header.Add(key, value)
+			}
+		}
+	}
+	if target.route != nil && target.route.disableKeepAlive {
+		ctx.SetConnectionClose()
+	}
+	ctx.SetStatusCode(res.StatusCode)
+	// an unknown length (-1) is sent chunked and flushed chunk by chunk, events are always sent that way
+	contentLength := int(res.ContentLength)
+	if strings.HasPrefix(res.Header.Get("Content-Type"), eventStreamContentType) {
+		contentLength = -1
+	}
+	ctx.Response.ImmediateHeaderFlush = true
+	ctx.SetBodyStream(&streamBody{ReadCloser: res.Body, done: func() {
+		cancel()
+		ep.stats.release()
+	}}, contentLength)
+}
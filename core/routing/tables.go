@@ -6,7 +6,7 @@ import (
 
 type ApiRouterTableMap struct {
 	sync.RWMutex
-	internal map[FrontendApiString]*Router
+	internal map[RouterNameString]*Router
 }
 
 type OnlineApiRouterTableMap struct {
@@ -31,30 +31,30 @@ type RouterTableMap struct {
 
 func NewApiRouterTableMap() *ApiRouterTableMap {
 	return &ApiRouterTableMap{
-		internal: make(map[FrontendApiString]*Router),
+		internal: make(map[RouterNameString]*Router),
 	}
 }
 
-func (m *ApiRouterTableMap) Load(key FrontendApiString) (value *Router, ok bool) {
+func (m *ApiRouterTableMap) Load(key RouterNameString) (value *Router, ok bool) {
 	m.RLock()
 	value, ok = m.internal[key]
 	m.RUnlock()
 	return value, ok
 }
 
-func (m *ApiRouterTableMap) Delete(key FrontendApiString) {
+func (m *ApiRouterTableMap) Delete(key RouterNameString) {
 	m.Lock()
 	delete(m.internal, key)
 	m.Unlock()
 }
 
-func (m *ApiRouterTableMap) Store(key FrontendApiString, value *Router) {
+func (m *ApiRouterTableMap) Store(key RouterNameString, value *Router) {
 	m.Lock()
 	m.internal[key] = value
 	m.Unlock()
 }
 
-func (m *ApiRouterTableMap) Range(f func(key FrontendApiString, value *Router)) {
+func (m *ApiRouterTableMap) Range(f func(key RouterNameString, value *Router)) {
 	m.RLock()
 	for k, v := range m.internal {
 		f(k, v)
@@ -62,7 +62,7 @@ func (m *ApiRouterTableMap) Range(f func(key FrontendApiString, value *Router))
 	m.RUnlock()
 }
 
-func (m *ApiRouterTableMap) unsafeRange(f func(key FrontendApiString, value *Router)) {
+func (m *ApiRouterTableMap) unsafeRange(f func(key RouterNameString, value *Router)) {
 	for k, v := range m.internal {
 		f(k, v)
 	}
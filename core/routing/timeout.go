@@ -0,0 +1,33 @@
+package routing
+
+import (
+	"fmt"
+	"github.com/hhjpin/goutils/errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// upstream timeout used when neither the router nor its service sets one
+	defaultUpstreamTimeout = 60 * time.Second
+)
+
+// parseTimeout parses the `Timeout` attribute of routers and services, the value is in milliseconds
+func parseTimeout(value []byte) (time.Duration, error) {
+	ms, err := strconv.ParseUint(string(value), 10, 32)
+	if err != nil {
+		return 0, errors.NewFormat(200, fmt.Sprintf("invalid timeout: %s", string(value)))
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// upstreamTimeout returns the timeout of the upstream call, the router overrides the default of its service
+func upstreamTimeout(router *Router) time.Duration {
+	if router.timeout > 0 {
+		return router.timeout
+	}
+	if router.service != nil && router.service.timeout > 0 {
+		return router.service.timeout
+	}
+	return defaultUpstreamTimeout
+}
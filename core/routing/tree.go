@@ -0,0 +1,148 @@
+package routing
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+)
+
+// routeTree is a prefix tree compiled from the online routers of a snapshot. Each level of the tree is one `/`
+// separated segment of a frontend api (the first segment carries the http method, e.g. `GET@`), so a lookup costs
+// time proportional to the length of the request path instead of the number of routers.
+//
+// Precedence between overlapping patterns is fixed: static segments first, then `:param`, then `*wildcard`.
+// Constrained parameters like `:id{[0-9]+}` are tried before unconstrained ones, a segment failing the constraint
+// skips that branch.
+// Routes sharing the same pattern are ordered by the number of their match predicates, the most specific first.
+// When no route of a pattern accepts the request, lookup falls through to the next candidate pattern.
+type routeTree struct {
+	root *treeNode
+}
+
+type treeNode struct {
+	static map[string]*treeNode
+	// parameter children, constrained ones first ordered by expression, the unconstrained one last
+	params   []*treeNode
+	wildcard *treeNode
+
+	// constraint of the parameter segment leading to this node, nil if unconstrained
+	constraint *regexp.Regexp
+
+	// routes whose frontend api ends at this node, most predicates first, then by router name
+	routes []*routeEntry
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{
+		static: make(map[string]*treeNode),
+	}
+}
+
+func newRouteTree(routes []*routeEntry) *routeTree {
+	t := &routeTree{root: newTreeNode()}
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].predicates) != len(routes[j].predicates) {
+			return len(routes[i].predicates) > len(routes[j].predicates)
+		}
+		return bytes.Compare(routes[i].name, routes[j].name) < 0
+	})
+	for _, route := range routes {
+		t.insert(route.frontend, route)
+	}
+	return t
+}
+
+func (t *routeTree) insert(pattern [][]byte, route *routeEntry) {
+	n := t.root
+	for idx, seg := range pattern {
+		if bytes.HasPrefix(seg, AnyMatchIdentifier) {
+			// wildcard consumes the rest of the path, segments behind it are never compared
+			if n.wildcard == nil {
+				n.wildcard = newTreeNode()
+			}
+			n = n.wildcard
+			break
+		} else if bytes.HasPrefix(seg, VariableIdentifier) {
+			var constraint *regexp.Regexp
+			if idx < len(route.constraints) {
+				constraint = route.constraints[idx]
+			}
+			n = n.paramChild(constraint)
+		} else {
+			child, ok := n.static[string(seg)]
+			if !ok {
+				child = newTreeNode()
+				n.static[string(seg)] = child
+			}
+			n = child
+		}
+	}
+	n.routes = append(n.routes, route)
+}
+
+// paramChild returns the parameter child with the same constraint, creating it if necessary
+func (n *treeNode) paramChild(constraint *regexp.Regexp) *treeNode {
+	for _, child := range n.params {
+		if constraintString(child.constraint) == constraintString(constraint) {
+			return child
+		}
+	}
+	child := newTreeNode()
+	child.constraint = constraint
+	n.params = append(n.params, child)
+	sort.SliceStable(n.params, func(i, j int) bool {
+		if (n.params[i].constraint == nil) != (n.params[j].constraint == nil) {
+			return n.params[i].constraint != nil
+		}
+		return constraintString(n.params[i].constraint) < constraintString(n.params[j].constraint)
+	})
+	return child
+}
+
+func constraintString(constraint *regexp.Regexp) string {
+	if constraint == nil {
+		return ""
+	}
+	return constraint.String()
+}
+
+// lookup returns the first route accepted by `accept` in precedence order, input is the request path split by `/`.
+// A nil accept function accepts every route.
+func (t *routeTree) lookup(input [][]byte, accept func(route *routeEntry) bool) *routeEntry {
+	if t == nil {
+		return nil
+	}
+	return t.root.lookup(input, 0, accept)
+}
+
+func (n *treeNode) lookup(input [][]byte, idx int, accept func(route *routeEntry) bool) *routeEntry {
+	if idx == len(input) {
+		return n.accept(accept)
+	}
+	if child, ok := n.static[string(input[idx])]; ok {
+		if found := child.lookup(input, idx+1, accept); found != nil {
+			return found
+		}
+	}
+	for _, child := range n.params {
+		if child.constraint != nil && !child.constraint.Match(input[idx]) {
+			continue
+		}
+		if found := child.lookup(input, idx+1, accept); found != nil {
+			return found
+		}
+	}
+	if n.wildcard != nil {
+		return n.wildcard.accept(accept)
+	}
+	return nil
+}
+
+func (n *treeNode) accept(accept func(route *routeEntry) bool) *routeEntry {
+	for _, route := range n.routes {
+		if accept == nil || accept(route) {
+			return route
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package routing
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"testing"
+)
+
+func newTestRoute(name, frontend string) *routeEntry {
+	return &routeEntry{
+		name:     []byte(name),
+		frontend: bytes.Split([]byte(frontend), UriSlash),
+	}
+}
+
+func TestRouteTreeLookup(t *testing.T) {
+	tree := newRouteTree([]*routeEntry{
+		newTestRoute("any", "GET@/front/*any"),
+		newTestRoute("param", "GET@/front/:id"),
+		newTestRoute("static", "GET@/front/list"),
+		newTestRoute("nested", "GET@/front/:id/detail"),
+		newTestRoute("post", "POST@/front/:id"),
+	})
+
+	cases := map[string]string{
+		"GET@/front/list":          "static",
+		"GET@/front/123":           "param",
+		"GET@/front/123/detail":    "nested",
+		"GET@/front/123/other":     "any",
+		"GET@/front/list/detail":   "nested",
+		"GET@/front/a/b/c":         "any",
+		"POST@/front/123":          "post",
+		"POST@/front/123/detail":   "",
+		"DELETE@/front/123":        "",
+		"GET@/other/front/123/abc": "",
+	}
+	for input, expected := range cases {
+		assertLookup(t, tree, input, nil, expected)
+	}
+}
+
+func TestRouteTreePredicates(t *testing.T) {
+	v2 := newTestRoute("v2", "GET@/front/:id")
+	v2.predicates = []*predicate{{Type: headerPredicate, Name: "X-Api-Version", Value: "2"}}
+	beta := newTestRoute("beta", "GET@/front/:id")
+	beta.predicates = []*predicate{
+		{Type: headerPredicate, Name: "X-Api-Version", Value: "2"},
+		{Type: cookiePredicate, Name: "beta", Value: "1"},
+	}
+	tree := newRouteTree([]*routeEntry{
+		newTestRoute("default", "GET@/front/:id"),
+		v2,
+		beta,
+		newTestRoute("any", "GET@/front/*any"),
+	})
+
+	var req fasthttp.Request
+	accept := func(route *routeEntry) bool {
+		return route.matchPredicates(&req)
+	}
+	assertLookup(t, tree, "GET@/front/1", accept, "default")
+
+	req.Header.Set("X-Api-Version", "2")
+	assertLookup(t, tree, "GET@/front/1", accept, "v2")
+
+	req.Header.SetCookie("beta", "1")
+	assertLookup(t, tree, "GET@/front/1", accept, "beta")
+
+	// no route of the param pattern accepts the request, falls through to the wildcard
+	assertLookup(t, tree, "GET@/front/1", func(route *routeEntry) bool {
+		return len(route.predicates) == 0 && string(route.name) != "default"
+	}, "any")
+}
+
+func TestRouteTreeConstraints(t *testing.T) {
+	var routes []*routeEntry
+	for name, frontend := range map[string]string{
+		"id":     "GET@/user/:id<int>",
+		"uuid":   "GET@/user/:id<uuid>",
+		"name":   "GET@/user/:name{[a-z]+}",
+		"other":  "GET@/user/:other",
+		"detail": "GET@/user/:id<int>/detail",
+		"any":    "GET@/user/*any",
+	} {
+		api, err := newFrontendApi([]byte(frontend))
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := newTestRoute(name, frontend)
+		route.constraints = api.constraints
+		routes = append(routes, route)
+	}
+	tree := newRouteTree(routes)
+
+	cases := map[string]string{
+		"GET@/user/123": "id",
+		"GET@/user/5f0b7a52-9c1e-4c7e-8d3a-0a1b2c3d4e5f": "uuid",
+		"GET@/user/alice":        "name",
+		"GET@/user/Alice":        "other",
+		"GET@/user/123/detail":   "detail",
+		"GET@/user/alice/detail": "any",
+	}
+	for input, expected := range cases {
+		assertLookup(t, tree, input, nil, expected)
+	}
+}
+
+func assertLookup(t *testing.T, tree *routeTree, input string, accept func(route *routeEntry) bool, expected string) {
+	route := tree.lookup(bytes.Split([]byte(input), UriSlash), accept)
+	if expected == "" {
+		if route != nil {
+			t.Fatalf("%s: expected no router, got %s", input, route.name)
+		}
+		return
+	}
+	if route == nil {
+		t.Fatalf("%s: expected router %s, got nothing", input, expected)
+	}
+	if string(route.name) != expected {
+		t.Fatalf("%s: expected router %s, got %s", input, expected, route.name)
+	}
+}
@@ -0,0 +1,289 @@
+package routing
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"git.henghajiang.com/backend/api_gateway_v2/core/constant"
+	"github.com/hhjpin/goutils/errors"
+	"github.com/hhjpin/goutils/logger"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWebSocketIdleTimeout = 5 * time.Minute
+	// time left to the server to write the handshake response and hand over the client connection
+	webSocketHijackTimeout = 5 * time.Second
+	webSocketBufferSize    = 4096
+
+	// states of a proxied websocket connection
+	webSocketPending   = 0
+	webSocketRelaying  = 1
+	webSocketAbandoned = 2
+)
+
+// webSocketRoute lets the upgrade requests of a router through, it is stored in etcd as a json object under
+// `/Router/Router-x/WebSocket`, e.g. `{"IdleTimeout": 300000, "MaxConns": 10000}`. IdleTimeout is in milliseconds
+// and defaults to 5 minutes, MaxConns limits the connections of the router in this gateway, 0 means unlimited.
+type webSocketRoute struct {
+	IdleTimeout int64 `json:"IdleTimeout"`
+	MaxConns    int64 `json:"MaxConns"`
+}
+
+// webSocketEntry is the read-only copy of a webSocketRoute, the connection counter belongs to the Router and is
+// shared by all snapshots
+type webSocketEntry struct {
+	idleTimeout time.Duration
+	maxConns    int64
+	conns       *int64
+}
+
+// webSocketProxy relays the websocket connections. The handshake is sent to the endpoint chosen by Select on a
+// dedicated connection, once the endpoint switched protocols the client connection is hijacked and the frames are
+// copied in both directions without being parsed. Https nodes are dialed over tls, h2c nodes receive the http/1.1
+// handshake as websocket over http/2 is not supported. A connection is closed when either side closes it or when no
+// frame was seen in either direction for the idle timeout of the router.
+type webSocketProxy struct {
+	outlier *outlierDetector
+}
+
+func parseWebSocketRoute(value []byte) (*webSocketRoute, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	ws := &webSocketRoute{}
+	if err := json.Unmarshal(value, ws); err != nil {
+		return nil, err
+	}
+	if ws.IdleTimeout < 0 || ws.MaxConns < 0 {
+		return nil, errors.NewFormat(200, fmt.Sprintf("invalid websocket option: %s", string(value)))
+	}
+	return ws, nil
+}
+
+func newWebSocketEntry(router *Router) *webSocketEntry {
+	if router.webSocket == nil {
+		return nil
+	}
+	idle := time.Duration(router.webSocket.IdleTimeout) * time.Millisecond
+	if idle <= 0 {
+		idle = defaultWebSocketIdleTimeout
+	}
+	return &webSocketEntry{idleTimeout: idle, maxConns: router.webSocket.MaxConns, conns: &router.webSocketConns}
+}
+
+// acquire takes a connection slot of the router, false is returned when the limit is reached
+func (w *webSocketEntry) acquire() bool {
+	if conns := atomic.AddInt64(w.conns, 1); w.maxConns > 0 && conns > w.maxConns {
+		atomic.AddInt64(w.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (w *webSocketEntry) release() {
+	atomic.AddInt64(w.conns, -1)
+}
+
+// isWebSocketUpgrade reports whether the client asks to switch the connection to the websocket protocol
+func isWebSocketUpgrade(ctx *fasthttp.RequestCtx) bool {
+	return ctx.IsGet() && ctx.Request.Header.ConnectionUpgrade() &&
+		bytes.EqualFold(ctx.Request.Header.Peek("Upgrade"), []byte("websocket"))
+}
+
+func newWebSocketProxy(outlier *outlierDetector) *webSocketProxy {
+	return &webSocketProxy{outlier: outlier}
+}
+
+// serve sends the handshake to the endpoint of the target and relays the connection once it is accepted. Responses
+// refusing the upgrade are answered to the client like a normal response. The in-flight slot taken by Select is
+// given back with the connection slot.
+func (p *webSocketProxy) serve(ctx *fasthttp.RequestCtx, target *TargetServer) {
+	ws := target.route.webSocket
+	ep := target.endpoint()
+	if !ws.acquire() {
+		ep.stats.unclaim()
+		ep.stats.release()
+		logger.Warnf("too many websocket connections on router %s", string(target.route.name))
+		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	release := func() {
+		ep.stats.release()
+		ws.release()
+	}
+
+	var backend net.Conn
+	var err error
+	if ep.scheme == httpsScheme {
+		backend, err = tls.DialWithDialer(&net.Dialer{Timeout: target.timeout}, "tcp", string(target.host), ep.tls.tlsConfig())
+	} else {
+		backend, err = net.DialTimeout("tcp", string(target.host), target.timeout)
+	}
+	if err != nil {
+		release()
+		p.fail(ctx, target, err)
+		return
+	}
+	_ = backend.SetDeadline(time.Now().Add(target.timeout))
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+	}()
+	uri := append([]byte(nil), target.uri...)
+	if queryString := ctx.QueryArgs().QueryString(); len(queryString) > 0 {
+		uri = append(append(uri, '?'), queryString...)
+	}
+	req.Header.SetRequestURIBytes(uri)
+	reqHop := newHopFilter(ctx.Request.Header.Peek("Connection"))
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		if reqHop.isHop(key) {
+			// pass
+		} else if bytes.Equal(key, constant.StrHost) {
+			req.Header.AddBytesV("X-Forwarded-Host", value)
+		} else if bytes.Equal(key, constant.StrContentType) {
+			req.Header.SetContentTypeBytes(value)
+		} else if bytes.Equal(key, constant.StrUserAgent) {
+			req.Header.SetUserAgentBytes(value)
+		} else {
+			req.Header.AddBytesKV(key, value)
+		}
+	})
+	req.Header.SetHostBytes(target.host)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	bw := bufio.NewWriter(backend)
+	br := bufio.NewReaderSize(backend, webSocketBufferSize)
+	if err = req.Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = res.Read(br)
+	}
+	if err != nil {
+		_ = backend.Close()
+		release()
+		p.fail(ctx, target, err)
+		return
+	}
+	if p.outlier != nil {
+		p.outlier.report(ep, nil, res.StatusCode())
+	}
+
+	resHop := newHopFilter(res.Header.Peek("Connection"))
+	res.Header.VisitAll(func(key, value []byte) {
+		if bytes.Equal(key, constant.StrHost) || resHop.isHop(key) {
+			// pass
+		} else {
+			ctx.Response.Header.SetBytesKV(key, value)
+		}
+	})
+	ctx.SetStatusCode(res.StatusCode())
+	if res.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		// the endpoint refused the upgrade
+		_ = backend.Close()
+		release()
+		if target.route.disableKeepAlive {
+			ctx.SetConnectionClose()
+		}
+		ctx.SetBody(res.Body())
+		return
+	}
+	ctx.Response.Header.Set("Connection", "Upgrade")
+	ctx.Response.Header.Set("Upgrade", "websocket")
+	_ = backend.SetDeadline(time.Time{})
+
+	// the hijack handler is not called when the response could not be written or the connection is closed after
+	// it, the endpoint connection is released by the timer then
+	var state int32
+	timer := time.AfterFunc(webSocketHijackTimeout, func() {
+		if atomic.CompareAndSwapInt32(&state, webSocketPending, webSocketAbandoned) {
+			_ = backend.Close()
+			release()
+		}
+	})
+	ctx.Hijack(func(client net.Conn) {
+		if !atomic.CompareAndSwapInt32(&state, webSocketPending, webSocketRelaying) {
+			return
+		}
+		timer.Stop()
+		relay(client, backend, br, ws.idleTimeout)
+		_ = backend.Close()
+		release()
+	})
+}
+
+// fail answers the client when the handshake could not be sent to the endpoint
+func (p *webSocketProxy) fail(ctx *fasthttp.RequestCtx, target *TargetServer, err error) {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = fasthttp.ErrTimeout
+	}
+	if p.outlier != nil {
+		p.outlier.report(target.endpoint(), err, 0)
+	}
+	if err == fasthttp.ErrTimeout {
+		logger.Warnf("upstream timeout after %s: %s%s", target.timeout, string(target.host), string(target.uri))
+		ctx.Error("Gateway Timeout", fasthttp.StatusGatewayTimeout)
+	} else {
+		logger.Error(err)
+		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+	}
+}
+
+// relay copies the bytes between the client and the endpoint until a side stops or both stay silent for the idle
+// timeout, the reader of the endpoint holds the bytes buffered along with the handshake. The idle timeout is
+// checked 4 times per period, a connection is closed at most a quarter period late. The connections are interrupted
+// by deadlines, the hijacked connection is closed by the server once the handler returns.
+func relay(client net.Conn, backend net.Conn, backendReader io.Reader, idle time.Duration) {
+	active := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		buf := make([]byte, webSocketBufferSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&active, time.Now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go pipe(backend, client)
+	go pipe(client, backendReader)
+
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	stopped := 0
+wait:
+	for {
+		select {
+		case <-done:
+			stopped++
+			break wait
+		case now := <-ticker.C:
+			if now.UnixNano()-atomic.LoadInt64(&active) > int64(idle) {
+				break wait
+			}
+		}
+	}
+	_ = client.SetDeadline(time.Now())
+	_ = backend.SetDeadline(time.Now())
+	for ; stopped < 2; stopped++ {
+		<-done
+	}
+}
@@ -86,9 +86,22 @@ func (ep *EndpointWatcher) Delete(key string) error {
 		return errors.NewFormat(200, fmt.Sprintf("invalid endpoint key: %s", key))
 	}
 	endpointId := tmp[0]
-	//endpointKey := ep.prefix + fmt.Sprintf("Node-%s/", endpointId)
+	endpointKey := ep.prefix + fmt.Sprintf("Node-%s/", endpointId)
 	logger.Debugf("[ETCD DELETE] Endpoint key: %s", key)
 
+	if tmp[1] == constant.WeightKeyString {
+		if _, exist := ep.table.GetEndpointById(endpointId); !exist {
+			// the whole endpoint has been deleted
+			return nil
+		}
+		// the weight was removed, the endpoint falls back to the default weight
+		if err := ep.table.RefreshEndpointById(endpointId, endpointKey); err != nil {
+			logger.Error(err)
+			return err
+		}
+		return nil
+	}
+
 	/*if ok, err := validKV(ep.cli, endpointKey, ep.attrs, true); err != nil || !ok {
 		logger.Warnf("endpoint attribute still exists, it may not have been deleted yet. Suggest to wait")
 		return nil
@@ -84,10 +84,29 @@ func (hc *HealthCheckWatcher) Delete(key string) error {
 	}
 	logger.Debugf("[ETCD DELETE] HealthCheck, key: %s", key)
 
+	if !hc.isRequiredAttr(tmp[1]) {
+		// an optional attribute was removed, endpoints still using the health check fall back to its default
+		hcId := tmp[0]
+		hcKey := hc.prefix + fmt.Sprintf(constant.HealthCheckPrefixString, hcId)
+		if err := hc.table.RefreshHealthCheck(hcId, hcKey); err != nil {
+			logger.Error(err)
+			return err
+		}
+		return nil
+	}
 	logger.Infof("HealthCheck delete event will not delete healthCheck object")
 	return nil
 }
 
+func (hc *HealthCheckWatcher) isRequiredAttr(attr string) bool {
+	for _, a := range hc.attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
 func (hc *HealthCheckWatcher) BindTable(table *routing.Table) {
 	hc.table = table
 }
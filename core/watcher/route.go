@@ -81,9 +81,22 @@ func (r *RouteWatcher) Delete(key string) error {
 		return errors.NewFormat(200, fmt.Sprintf("invalid router key: %s", key))
 	}
 	routeName := tmp[0]
-	//routeKey := r.prefix + fmt.Sprintf("Router-%s/", routeName)
+	routeKey := r.prefix + fmt.Sprintf("Router-%s/", routeName)
 	logger.Debugf("新的Router删除事件, name: %s, key: %s", routeName, key)
 
+	if !r.isRequiredAttr(tmp[1]) {
+		if _, err := r.table.GetRouterByName([]byte(routeName)); err != nil {
+			// the whole router has been deleted
+			return nil
+		}
+		// an optional attribute was removed, the router itself still exists
+		if err := r.table.RefreshRouterByName(routeName, routeKey); err != nil {
+			logger.Error(err)
+			return err
+		}
+		return nil
+	}
+
 	//if ok, err := validKV(r.cli, routeKey, r.attrs, true); err != nil || !ok {
 	//	logger.Warnf("route attribute still exists, it may not have been deleted yet. Suggest to wait")
 	//	return nil
@@ -96,6 +109,15 @@ func (r *RouteWatcher) Delete(key string) error {
 	//}
 }
 
+func (r *RouteWatcher) isRequiredAttr(attr string) bool {
+	for _, a := range r.attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *RouteWatcher) BindTable(table *routing.Table) {
 	r.table = table
 }
@@ -92,6 +92,18 @@ func (s *ServiceWatcher) Delete(key string) error {
 	svrName := tmp[0]
 	svrKey := s.prefix + fmt.Sprintf(constant.ServicePrefixString, svrName)
 	logger.Debugf("新的Service删除事件, name: %s, key: %s", svrName, svrKey)
+	if !s.isRequiredAttr(tmp[1]) {
+		if _, err := s.table.GetServiceByName([]byte(svrName)); err != nil {
+			// the whole service has been deleted
+			return nil
+		}
+		// an optional attribute was removed, the service itself still exists
+		if err := s.table.RefreshServiceByName(svrName, svrKey); err != nil {
+			logger.Error(err)
+			return err
+		}
+		return nil
+	}
 	if ok, err := validKV(s.cli, svrKey, s.attrs, true); err != nil || !ok {
 		logger.Warnf("service attribute still exists, it may not have been deleted yet. Suggest to wait")
 		return nil
@@ -103,3 +115,12 @@ func (s *ServiceWatcher) Delete(key string) error {
 		return nil
 	}
 }
+
+func (s *ServiceWatcher) isRequiredAttr(attr string) bool {
+	for _, a := range s.attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"git.henghajiang.com/backend/api_gateway_v2/sdk/golang"
@@ -42,6 +43,11 @@ func exit(gw *golang.ApiGatewayRegistrant) {
 	if err := gw.Unregister(); err != nil {
 		logger.Error(err)
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := gw.WaitDrained(ctx); err != nil {
+		logger.Error(err)
+	}
+	cancel()
 	os.Exit(0)
 }
 
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"git.henghajiang.com/backend/api_gateway_v2/client"
 	"git.henghajiang.com/backend/api_gateway_v2/conf"
+	"git.henghajiang.com/backend/api_gateway_v2/core/certs"
 	"git.henghajiang.com/backend/api_gateway_v2/core/routing"
 	"git.henghajiang.com/backend/api_gateway_v2/core/watcher"
 	"git.henghajiang.com/backend/api_gateway_v2/middleware"
@@ -98,13 +100,10 @@ func init() {
 	go client.Run(table)
 }
 
-func main() {
-	var server *fasthttp.Server
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
+// newServer returns a gateway server, the plain and the https listeners are served by distinct servers
+func newServer() *fasthttp.Server {
 	serverConf := conf.Conf.Server
-	server = &fasthttp.Server{
+	return &fasthttp.Server{
 		Handler: routing.MainRequestHandlerWrapper(table, middleware.Limiter),
 
 		Name:               serverConf.Name,
@@ -114,7 +113,59 @@ func main() {
 		DisableKeepalive:   serverConf.DisabledKeepAlive,
 		ReduceMemoryUsage:  serverConf.ReduceMemoryUsage,
 		MaxRequestBodySize: serverConf.MaxRequestBodySize,
+
+		// the bodies are streamed to the streaming routers, the others still read them within MaxRequestBodySize
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+}
+
+// serveTLS starts the https listener if `Server.TLS.ListenPort` is set, the certificates are picked by SNI and
+// reloaded when their files change
+func serveTLS() {
+	serverConf := conf.Conf.Server
+	if serverConf.TLS.ListenPort <= 0 {
+		return
+	}
+	minVersion, err := certs.ParseMinVersion(serverConf.TLS.MinVersion)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	pairs := make([]certs.KeyPair, 0, len(serverConf.TLS.Certificates))
+	for _, c := range serverConf.TLS.Certificates {
+		pairs = append(pairs, certs.KeyPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	store, err := certs.NewStore(pairs)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
 	}
+	go store.Watch(time.Duration(serverConf.TLS.ReloadInterval) * time.Second)
+
+	host := fmt.Sprintf("%s:%d", serverConf.ListenHost, serverConf.TLS.ListenPort)
+	logger.Infof("gateway https server start at: %s", host)
+	listener, err := reuseport.Listen("tcp4", host)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	go func() {
+		if err := newServer().Serve(tls.NewListener(listener, store.Config(minVersion))); err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+	}()
+}
+
+func main() {
+	var server *fasthttp.Server
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	serverConf := conf.Conf.Server
+	server = newServer()
+	serveTLS()
 
 	host := fmt.Sprintf("%s:%d", serverConf.ListenHost, serverConf.ListenPort)
 	logger.Infof("gateway server start at: %s", host)
@@ -1,5 +1,7 @@
 package golang
 
+import "time"
+
 const (
 	RouterDefinitionPrefix  = "/Router/"
 	ServiceDefinitionPrefix = "/Service/"
@@ -8,6 +10,7 @@ const (
 	ServiceDefinition     = "/Service/Service-%s/"
 	HealthCheckDefinition = "/HealthCheck/HC-%s/"
 	RouterDefinition      = "/Router/Router-%s/"
+	DrainDefinition       = "/Drain/Node-%s/"
 
 	IDKey          = "ID"
 	NameKey        = "Name"
@@ -24,6 +27,60 @@ const (
 	FrontendKey    = "FrontendApi"
 	BackendKey     = "BackendApi"
 	ServiceKey     = "Service"
+	MatchKey       = "Match"
+
+	AcceptHttpMethodKey   = "AcceptHttpMethod"
+	MaxAttemptsKey        = "MaxAttempts"
+	RetryNonIdempotentKey = "RetryNonIdempotent"
+	WeightKey             = "Weight"
+	LoadBalancerKey       = "LoadBalancer"
+	HashKeyKey            = "HashKey"
+	SplitKey              = "Split"
+	MirrorKey             = "Mirror"
+	TypeKey               = "Type"
+	MethodKey             = "Method"
+	HeadersKey            = "Headers"
+	ExpectStatusKey       = "ExpectStatus"
+	BodyContainsKey       = "BodyContains"
+	BodyRegexKey          = "BodyRegex"
+	SlowStartKey          = "SlowStart"
+
+	MaxConnsKey            = "MaxConns"
+	MaxIdleConnDurationKey = "MaxIdleConnDuration"
+	KeepAliveKey           = "KeepAlive"
+	StreamingKey           = "Streaming"
+	WebSocketKey           = "WebSocket"
+	SchemeKey              = "Scheme"
+	TLSKey                 = "TLS"
+
+	DefaultWeight = 1
+
+	// node status written by Unregister, the gateways stop sending new requests at once
+	DrainingStatus = 3
+	// time given to the gateways to see the draining status and report their requests in flight
+	DrainSettleTime   = 2 * time.Second
+	DrainPollInterval = 500 * time.Millisecond
+
+	HeaderMatch = "header"
+	QueryMatch  = "query"
+	CookieMatch = "cookie"
+
+	SplitHeaderOverride = "header:"
+	SplitCookieOverride = "cookie:"
+
+	TCPCheck   = "tcp"
+	HTTPCheck  = "http"
+	HTTPSCheck = "https"
+	GRPCCheck  = "grpc"
+
+	HTTPScheme  = "http"
+	HTTPSScheme = "https"
+	H2CScheme   = "h2c"
+
+	RoundRobinBalancer     = "round_robin"
+	LeastRequestBalancer   = "least_request"
+	PowerOfTwoBalancer     = "p2c"
+	ConsistentHashBalancer = "consistent_hash"
 )
 
 var (
@@ -23,11 +23,45 @@ type Node struct {
 	Port   int
 	Status uint8
 	HC     *HealthCheck
+	// share of traffic relative to the other nodes of the service, 0 keeps the node registered without traffic
+	Weight int
+	// optional protocol spoken by the node, see the `*Scheme` constants. Http when empty
+	Scheme string
+	// optional tls options of https nodes
+	TLS *NodeTLS
 }
+
+// NodeTLS are the options used by the gateways to verify https nodes. CA is a pem bundle replacing the system roots,
+// ServerName is verified instead of the node host. InsecureSkipVerify disables the verification, only use it for
+// development.
+type NodeTLS struct {
+	CA                 string `json:",omitempty"`
+	ServerName         string `json:",omitempty"`
+	InsecureSkipVerify bool   `json:",omitempty"`
+}
+
+// NodeOption sets an optional attribute of Node
+type NodeOption func(n *Node)
 type Service struct {
 	Name string
 	Node []*Node
+	// optional http methods accepted by the service, the gateway answers other methods with 405. Empty accepts all
+	AcceptHttpMethod []string
+	// optional default upstream timeout of the routers bound to the service
+	Timeout time.Duration
+	// optional endpoint selection strategy, see the `*Balancer` constants. Round-robin when empty
+	LoadBalancer string
+	// request key of the consistent hash balancer: `ip`, `header:<name>` or `cookie:<name>`
+	HashKey string
+	// optional ramp-up window of nodes coming back online, their share grows from 10% to full over it
+	SlowStart time.Duration
+	// optional limits of the gateway connection pool of each node, the gateway config is used when not set
+	MaxConns            int
+	MaxIdleConnDuration time.Duration
 }
+
+// ServiceOption sets an optional attribute of Service
+type ServiceOption func(s *Service)
 type Router struct {
 	ID       string
 	Name     string
@@ -36,7 +70,65 @@ type Router struct {
 	Frontend string
 	Backend  string
 	Service  *Service
+	// optional host pattern, exact host or wildcard like `*.example.com`
+	Host string
+	// optional header/query/cookie predicates, all of them must be satisfied
+	Match []*MatchPredicate
+	// optional upstream timeout, overrides the default timeout of the service
+	Timeout time.Duration
+	// optional max attempts of the upstream call including the first one, overrides the gateway default
+	MaxAttempts int
+	// retry non-idempotent requests like POST as well
+	RetryNonIdempotent bool
+	// close the client connection after each response, keep-alive follows the gateway config otherwise
+	DisableKeepAlive bool
+	// pipe the response body to the client without buffering it, e.g. for file downloads
+	Streaming bool
+	// optional websocket options, upgrade requests are only relayed when set
+	WebSocket *WebSocket
+	// optional traffic split between several services, e.g. for canary releases
+	Split *TrafficSplit
+	// optional shadow service receiving a copy of the requests
+	Mirror *TrafficMirror
+}
+
+// TrafficSplit spreads the requests of a router over several services by weight. A request carrying the Override
+// header or cookie, `header:<name>` or `cookie:<name>`, is sent to the service named by its value.
+type TrafficSplit struct {
+	Services []*SplitService
+	Override string `json:",omitempty"`
+}
+
+type SplitService struct {
+	Service string
+	Weight  int
 }
+
+// TrafficMirror copies Percent of the requests of a router to a shadow service, the shadow responses are
+// discarded. Mirrored requests carry the `X-Gateway-Mirror` header.
+type TrafficMirror struct {
+	Service string
+	Percent float64
+}
+
+// WebSocket lets the websocket upgrade requests of a router through the gateway. IdleTimeout is in milliseconds,
+// the gateway closes connections without frames in either direction for 5 minutes by default. MaxConns limits the
+// connections of the router in each gateway, 0 means unlimited.
+type WebSocket struct {
+	IdleTimeout int64 `json:",omitempty"`
+	MaxConns    int64 `json:",omitempty"`
+}
+
+// MatchPredicate is a router match condition on a header, query parameter or cookie. An empty Value only
+// requires the header, query parameter or cookie to be present.
+type MatchPredicate struct {
+	Type  string
+	Name  string
+	Value string
+}
+
+// RouterOption sets an optional attribute of Router
+type RouterOption func(r *Router)
 type HealthCheck struct {
 	ID        string
 	Path      string
@@ -44,8 +136,21 @@ type HealthCheck struct {
 	Interval  uint8
 	Retry     bool
 	RetryTime uint8
+	// optional prober: tcp, http, https or grpc, http when empty. Path is the service name of grpc checks
+	Type string
+	// optional request of http checks
+	Method  string
+	Host    string
+	Headers map[string]string
+	// optional assertions of http checks, any 2xx/3xx status is healthy when ExpectStatus is empty
+	ExpectStatus []int
+	BodyContains string
+	BodyRegex    string
 }
 
+// HealthCheckOption sets an optional attribute of HealthCheck
+type HealthCheckOption func(hc *HealthCheck)
+
 type ApiGatewayRegistrant struct {
 	cli *clientv3.Client
 
@@ -55,47 +160,261 @@ type ApiGatewayRegistrant struct {
 	router  []*Router
 }
 
-func NewHealthCheck(path string, timeout, interval, retryTime uint8, retry bool) *HealthCheck {
-	return &HealthCheck{
+func NewHealthCheck(path string, timeout, interval, retryTime uint8, retry bool, opts ...HealthCheckOption) *HealthCheck {
+	hc := &HealthCheck{
 		Path:      path,
 		Timeout:   timeout,
 		Interval:  interval,
 		Retry:     retry,
 		RetryTime: retryTime,
 	}
+	for _, opt := range opts {
+		opt(hc)
+	}
+	return hc
+}
+
+// WithCheckType sets the prober of the health check: TCPCheck, HTTPCheck, HTTPSCheck or GRPCCheck
+func WithCheckType(typ string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.Type = typ
+	}
+}
+
+// WithCheckMethod sets the method of http checks, GET by default
+func WithCheckMethod(method string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.Method = strings.ToUpper(method)
+	}
+}
+
+// WithCheckHost sets the Host header of http checks, the address of the node by default
+func WithCheckHost(host string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.Host = host
+	}
+}
+
+// WithCheckHeader adds a header to http checks
+func WithCheckHeader(name, value string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		if hc.Headers == nil {
+			hc.Headers = make(map[string]string)
+		}
+		hc.Headers[name] = value
+	}
+}
+
+// WithExpectStatus only accepts the listed status codes as healthy
+func WithExpectStatus(status ...int) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.ExpectStatus = append(hc.ExpectStatus, status...)
+	}
+}
+
+// WithBodyContains requires the body of http checks to contain the substring, e.g. `"status":"ok"`
+func WithBodyContains(substr string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.BodyContains = substr
+	}
+}
+
+// WithBodyRegex requires the body of http checks to match the regular expression
+func WithBodyRegex(expr string) HealthCheckOption {
+	return func(hc *HealthCheck) {
+		hc.BodyRegex = expr
+	}
+}
+
+// attrs returns the optional attributes of the health check which are set
+func (hc *HealthCheck) attrs(hcDefinition string) map[string]string {
+	kvs := make(map[string]string)
+	if hc.Type != "" {
+		kvs[hcDefinition+TypeKey] = hc.Type
+	}
+	if hc.Method != "" {
+		kvs[hcDefinition+MethodKey] = hc.Method
+	}
+	if hc.Host != "" {
+		kvs[hcDefinition+HostKey] = hc.Host
+	}
+	if len(hc.Headers) > 0 {
+		headers, err := json.Marshal(hc.Headers)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[hcDefinition+HeadersKey] = string(headers)
+	}
+	if len(hc.ExpectStatus) > 0 {
+		status, err := json.Marshal(hc.ExpectStatus)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[hcDefinition+ExpectStatusKey] = string(status)
+	}
+	if hc.BodyContains != "" {
+		kvs[hcDefinition+BodyContainsKey] = hc.BodyContains
+	}
+	if hc.BodyRegex != "" {
+		kvs[hcDefinition+BodyRegexKey] = hc.BodyRegex
+	}
+	return kvs
+}
+
+// unsetAttrs returns the keys of optional attributes which are not set on the health check
+func (hc *HealthCheck) unsetAttrs(hcDefinition string) []string {
+	var keys []string
+	set := hc.attrs(hcDefinition)
+	for _, attr := range []string{TypeKey, MethodKey, HostKey, HeadersKey, ExpectStatusKey, BodyContainsKey, BodyRegexKey} {
+		if _, ok := set[hcDefinition+attr]; !ok {
+			keys = append(keys, hcDefinition+attr)
+		}
+	}
+	return keys
 }
 
-func NewNode(host string, port int, hc *HealthCheck) *Node {
+func NewNode(host string, port int, hc *HealthCheck, opts ...NodeOption) *Node {
 	uid := fmt.Sprintf("%s-%d", host, port)
 	hc.ID = uid
-	return &Node{
+	n := &Node{
 		ID:     uid,
 		Name:   uid,
 		Host:   host,
 		Port:   port,
 		Status: 2,
 		HC:     hc,
+		Weight: DefaultWeight,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// WithWeight sets the weight of the node for weighted round-robin, 0 means registered but receives no traffic
+func WithWeight(weight int) NodeOption {
+	return func(n *Node) {
+		n.Weight = weight
+	}
+}
+
+// WithScheme sets the protocol spoken by the node: `https` or `h2c` (http/2 without tls)
+func WithScheme(scheme string) NodeOption {
+	return func(n *Node) {
+		n.Scheme = scheme
+	}
+}
+
+// WithTLS calls the node over https with the tls options, e.g. `WithTLS(&NodeTLS{ServerName: "order.internal"})`
+func WithTLS(tls *NodeTLS) NodeOption {
+	return func(n *Node) {
+		n.Scheme = HTTPSScheme
+		n.TLS = tls
+	}
+}
+
+// attrs returns the optional attributes of the node which are set
+func (n *Node) attrs(nodeDefinition string) map[string]string {
+	kvs := make(map[string]string)
+	if n.Scheme != "" {
+		kvs[nodeDefinition+SchemeKey] = n.Scheme
+	}
+	if n.TLS != nil {
+		tls, err := json.Marshal(n.TLS)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[nodeDefinition+TLSKey] = string(tls)
+	}
+	return kvs
+}
+
+// unsetAttrs returns the keys of optional attributes which are not set on the node
+func (n *Node) unsetAttrs(nodeDefinition string) []string {
+	var keys []string
+	set := n.attrs(nodeDefinition)
+	for _, attr := range []string{SchemeKey, TLSKey} {
+		if _, ok := set[nodeDefinition+attr]; !ok {
+			keys = append(keys, nodeDefinition+attr)
+		}
 	}
+	return keys
 }
 
-func NewService(name string, node *Node) *Service {
-	return &Service{
+func NewService(name string, node *Node, opts ...ServiceOption) *Service {
+	s := &Service{
 		Name: name,
 		Node: []*Node{node},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithServiceTimeout sets the default upstream timeout of the routers bound to the service
+func WithServiceTimeout(timeout time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.Timeout = timeout
+	}
+}
+
+// WithLoadBalancer sets the endpoint selection strategy of the service
+func WithLoadBalancer(lb string) ServiceOption {
+	return func(s *Service) {
+		s.LoadBalancer = lb
+	}
+}
+
+// WithConsistentHash balances the requests by consistent hashing of the key, requests with the same key reach the
+// same node as long as it is online. Key is `ip`, `header:<name>` or `cookie:<name>`
+func WithConsistentHash(key string) ServiceOption {
+	return func(s *Service) {
+		s.LoadBalancer = ConsistentHashBalancer
+		s.HashKey = key
+	}
+}
+
+// WithSlowStart ramps up the traffic of nodes coming back online over the window, e.g. to warm up caches
+func WithSlowStart(window time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.SlowStart = window
+	}
+}
+
+// WithMaxConns limits the connections opened by each gateway to each node of the service
+func WithMaxConns(conns int) ServiceOption {
+	return func(s *Service) {
+		s.MaxConns = conns
+	}
+}
+
+// WithMaxIdleConnDuration closes the idle gateway connections to the nodes of the service after the duration
+func WithMaxIdleConnDuration(duration time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.MaxIdleConnDuration = duration
+	}
+}
+
+// WithAcceptHttpMethod limits the http methods accepted by the service
+func WithAcceptHttpMethod(methods ...string) ServiceOption {
+	return func(s *Service) {
+		for _, m := range methods {
+			s.AcceptHttpMethod = append(s.AcceptHttpMethod, strings.ToUpper(m))
+		}
+	}
 }
 
-func NewRouter(name, method, frontend, backend string, service *Service) *Router {
+func NewRouter(name, method, frontend, backend string, service *Service, opts ...RouterOption) *Router {
 	method = strings.ToUpper(method)
-	src := fmt.Sprintf("%s - %s - %s - %s - %s", name, method, frontend, backend, service.Name)
-	fmt.Println(">> GATE route: ", src)
 	if strings.Contains(name, "/") {
 		logger.Errorf("name can not contains '/'")
 		os.Exit(-1)
 	}
-	md5str := fmt.Sprintf("%x", md5.Sum([]byte(src)))
-	return &Router{
-		ID:       md5str,
+	r := &Router{
 		Name:     name,
 		Status:   0,
 		Method:   method,
@@ -103,6 +422,234 @@ func NewRouter(name, method, frontend, backend string, service *Service) *Router
 		Backend:  backend,
 		Service:  service,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	src := fmt.Sprintf("%s - %s - %s - %s - %s", name, method, frontend, backend, service.Name)
+	if r.Host != "" {
+		src += " - " + r.Host
+	}
+	for _, m := range r.Match {
+		src += fmt.Sprintf(" - %s:%s=%s", m.Type, m.Name, m.Value)
+	}
+	fmt.Println(">> GATE route: ", src)
+	r.ID = fmt.Sprintf("%x", md5.Sum([]byte(src)))
+	return r
+}
+
+// WithHost binds the router to a host, exact host or wildcard like `*.example.com`
+func WithHost(host string) RouterOption {
+	return func(r *Router) {
+		r.Host = strings.ToLower(host)
+	}
+}
+
+// WithHeaderMatch requires the request header `name` to equal `value`
+func WithHeaderMatch(name, value string) RouterOption {
+	return withMatch(HeaderMatch, name, value)
+}
+
+// WithQueryMatch requires the query parameter `name` to equal `value`
+func WithQueryMatch(name, value string) RouterOption {
+	return withMatch(QueryMatch, name, value)
+}
+
+// WithCookieMatch requires the cookie `name` to equal `value`
+func WithCookieMatch(name, value string) RouterOption {
+	return withMatch(CookieMatch, name, value)
+}
+
+// WithTimeout sets the upstream timeout of the router, the gateway answers 504 when it is exceeded
+func WithTimeout(timeout time.Duration) RouterOption {
+	return func(r *Router) {
+		r.Timeout = timeout
+	}
+}
+
+// WithMaxAttempts sets the max attempts of the upstream call, failed calls are retried on another endpoint
+func WithMaxAttempts(attempts int) RouterOption {
+	return func(r *Router) {
+		r.MaxAttempts = attempts
+	}
+}
+
+// WithRetryNonIdempotent allows retrying non-idempotent requests, only use it when the backend api is safe to
+// be called repeatedly
+func WithRetryNonIdempotent() RouterOption {
+	return func(r *Router) {
+		r.RetryNonIdempotent = true
+	}
+}
+
+// WithoutKeepAlive closes the client connection after each response of the router, e.g. for rarely called apis
+func WithoutKeepAlive() RouterOption {
+	return func(r *Router) {
+		r.DisableKeepAlive = true
+	}
+}
+
+// WithStreaming proxies the router in streaming mode, the response body is sent to the client while it is received
+// from the node. Streaming calls are neither retried nor mirrored, and the timeout only applies until the response
+// header is received.
+func WithStreaming() RouterOption {
+	return func(r *Router) {
+		r.Streaming = true
+	}
+}
+
+// WithWebSocket relays the websocket connections of the router, e.g. `WithWebSocket(10*time.Minute, 10000)`. A zero
+// idle timeout uses the gateway default and a zero maxConns means unlimited.
+func WithWebSocket(idleTimeout time.Duration, maxConns int) RouterOption {
+	return func(r *Router) {
+		r.WebSocket = &WebSocket{IdleTimeout: int64(idleTimeout / time.Millisecond), MaxConns: int64(maxConns)}
+	}
+}
+
+// WithSplit spreads the requests of the router over the services by weight, e.g. 95 to `order-v1` and 5 to
+// `order-v2`. The Service of the router is used when none of them has an online endpoint.
+func WithSplit(services ...*SplitService) RouterOption {
+	return func(r *Router) {
+		if r.Split == nil {
+			r.Split = &TrafficSplit{}
+		}
+		r.Split.Services = append(r.Split.Services, services...)
+	}
+}
+
+// WithSplitHeaderOverride sends requests with the header `name` to the split service named by its value
+func WithSplitHeaderOverride(name string) RouterOption {
+	return withSplitOverride(SplitHeaderOverride + name)
+}
+
+// WithSplitCookieOverride sends requests with the cookie `name` to the split service named by its value
+func WithSplitCookieOverride(name string) RouterOption {
+	return withSplitOverride(SplitCookieOverride + name)
+}
+
+// WithMirror copies `percent` (0-100) of the requests of the router to the service
+func WithMirror(service string, percent float64) RouterOption {
+	return func(r *Router) {
+		r.Mirror = &TrafficMirror{Service: service, Percent: percent}
+	}
+}
+
+func withSplitOverride(override string) RouterOption {
+	return func(r *Router) {
+		if r.Split == nil {
+			r.Split = &TrafficSplit{}
+		}
+		r.Split.Override = override
+	}
+}
+
+func withMatch(typ, name, value string) RouterOption {
+	return func(r *Router) {
+		r.Match = append(r.Match, &MatchPredicate{Type: typ, Name: name, Value: value})
+	}
+}
+
+// attrs returns all attributes of the router stored in etcd, optional attributes are only included when set
+func (r *Router) attrs(routerName, frontend string) map[string]string {
+	kvs := map[string]string{
+		routerName + IDKey:       r.ID,
+		routerName + NameKey:     r.Name,
+		routerName + StatusKey:   strconv.FormatUint(uint64(r.Status), 10),
+		routerName + FrontendKey: frontend,
+		routerName + BackendKey:  r.Backend,
+		routerName + ServiceKey:  r.Service.Name,
+	}
+	if r.Host != "" {
+		kvs[routerName+HostKey] = r.Host
+	}
+	if len(r.Match) > 0 {
+		match, err := json.Marshal(r.Match)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[routerName+MatchKey] = string(match)
+	}
+	if r.Timeout > 0 {
+		kvs[routerName+TimeoutKey] = formatTimeout(r.Timeout)
+	}
+	if r.MaxAttempts > 0 {
+		kvs[routerName+MaxAttemptsKey] = strconv.Itoa(r.MaxAttempts)
+	}
+	if r.RetryNonIdempotent {
+		kvs[routerName+RetryNonIdempotentKey] = strconv.FormatBool(r.RetryNonIdempotent)
+	}
+	if r.DisableKeepAlive {
+		kvs[routerName+KeepAliveKey] = strconv.FormatBool(false)
+	}
+	if r.Streaming {
+		kvs[routerName+StreamingKey] = strconv.FormatBool(r.Streaming)
+	}
+	if r.WebSocket != nil {
+		ws, err := json.Marshal(r.WebSocket)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[routerName+WebSocketKey] = string(ws)
+	}
+	if r.Split != nil && len(r.Split.Services) > 0 {
+		split, err := json.Marshal(r.Split)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[routerName+SplitKey] = string(split)
+	}
+	if r.Mirror != nil {
+		mirror, err := json.Marshal(r.Mirror)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(-1)
+		}
+		kvs[routerName+MirrorKey] = string(mirror)
+	}
+	return kvs
+}
+
+// unsetAttrs returns the keys of optional attributes which are not set on the router
+func (r *Router) unsetAttrs(routerName string) []string {
+	var keys []string
+	if r.Host == "" {
+		keys = append(keys, routerName+HostKey)
+	}
+	if len(r.Match) == 0 {
+		keys = append(keys, routerName+MatchKey)
+	}
+	if r.Timeout <= 0 {
+		keys = append(keys, routerName+TimeoutKey)
+	}
+	if r.MaxAttempts <= 0 {
+		keys = append(keys, routerName+MaxAttemptsKey)
+	}
+	if !r.RetryNonIdempotent {
+		keys = append(keys, routerName+RetryNonIdempotentKey)
+	}
+	if !r.DisableKeepAlive {
+		keys = append(keys, routerName+KeepAliveKey)
+	}
+	if !r.Streaming {
+		keys = append(keys, routerName+StreamingKey)
+	}
+	if r.WebSocket == nil {
+		keys = append(keys, routerName+WebSocketKey)
+	}
+	if r.Split == nil || len(r.Split.Services) == 0 {
+		keys = append(keys, routerName+SplitKey)
+	}
+	if r.Mirror == nil {
+		keys = append(keys, routerName+MirrorKey)
+	}
+	return keys
+}
+
+// formatTimeout formats the timeout in milliseconds as stored in etcd
+func formatTimeout(timeout time.Duration) string {
+	return strconv.FormatInt(int64(timeout/time.Millisecond), 10)
 }
 
 func NewApiGatewayRegistrant(cli *clientv3.Client, node *Node, service *Service, router []*Router) ApiGatewayRegistrant {
@@ -349,6 +896,9 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 			kvs[hcDefinition+RetryKey] = "0"
 		}
 		kvs[hcDefinition+RetryTimeKey] = strconv.FormatUint(uint64(hc.RetryTime), 10)
+		for k, v := range hc.attrs(hcDefinition) {
+			kvs[k] = v
+		}
 	} else {
 		id := gw.getAttr(hcDefinition + IDKey)
 		path := gw.getAttr(hcDefinition + PathKey)
@@ -378,6 +928,11 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 		if retryTime != strconv.FormatInt(int64(hc.RetryTime), 10) {
 			kvs[hcDefinition+RetryTimeKey] = strconv.FormatInt(int64(hc.RetryTime), 10)
 		}
+		for k, v := range hc.attrs(hcDefinition) {
+			if gw.getAttr(k) != v {
+				kvs[k] = v
+			}
+		}
 		if len(kvs) > 0 {
 			logger.Infof("node keys waiting to be updated: %+v", kvs)
 		}
@@ -388,6 +943,10 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 		logger.Error(err)
 		return err
 	}
+	if err = gw.deleteMany(hc.unsetAttrs(hcDefinition)); err != nil {
+		logger.Error(err)
+		return err
+	}
 
 	nodeDefinition := fmt.Sprintf(NodeDefinition, gw.node.ID)
 	resp, err = gw.getKeyValueWithPrefix(nodeDefinition)
@@ -404,12 +963,17 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 		kvs[nodeDefinition+PortKey] = strconv.FormatInt(int64(n.Port), 10)
 		kvs[nodeDefinition+StatusKey] = strconv.FormatUint(uint64(n.Status), 10)
 		kvs[nodeDefinition+HealthCheckKey] = n.HC.ID
+		kvs[nodeDefinition+WeightKey] = strconv.Itoa(n.Weight)
+		for k, v := range n.attrs(nodeDefinition) {
+			kvs[k] = v
+		}
 	} else {
 		id := gw.getAttr(nodeDefinition + IDKey)
 		name := gw.getAttr(nodeDefinition + NameKey)
 		host := gw.getAttr(nodeDefinition + HostKey)
 		port := gw.getAttr(nodeDefinition + PortKey)
 		healthCheck := gw.getAttr(nodeDefinition + HealthCheckKey)
+		weight := gw.getAttr(nodeDefinition + WeightKey)
 		if id != n.ID {
 			kvs[nodeDefinition+IDKey] = n.ID
 		}
@@ -426,6 +990,14 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 		if healthCheck != n.HC.ID {
 			kvs[nodeDefinition+HealthCheckKey] = n.HC.ID
 		}
+		if weight != strconv.Itoa(n.Weight) {
+			kvs[nodeDefinition+WeightKey] = strconv.Itoa(n.Weight)
+		}
+		for k, v := range n.attrs(nodeDefinition) {
+			if gw.getAttr(k) != v {
+				kvs[k] = v
+			}
+		}
 		kvs[nodeDefinition+StatusKey] = "2"
 		if len(kvs) > 0 {
 			logger.Infof("node keys waiting to be updated: %+v", kvs)
@@ -437,6 +1009,10 @@ func (gw *ApiGatewayRegistrant) registerNode() error {
 		logger.Error(err)
 		return err
 	}
+	if err = gw.deleteMany(n.unsetAttrs(nodeDefinition)); err != nil {
+		logger.Error(err)
+		return err
+	}
 
 	return nil
 }
@@ -495,11 +1071,63 @@ func (gw *ApiGatewayRegistrant) registerService() error {
 			}
 		}
 	}
+	if len(gw.service.AcceptHttpMethod) > 0 {
+		methods, err := json.Marshal(gw.service.AcceptHttpMethod)
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+		kvs[serviceDefinition+AcceptHttpMethodKey] = string(methods)
+	}
+	if gw.service.Timeout > 0 {
+		kvs[serviceDefinition+TimeoutKey] = formatTimeout(gw.service.Timeout)
+	}
+	if gw.service.LoadBalancer != "" {
+		kvs[serviceDefinition+LoadBalancerKey] = gw.service.LoadBalancer
+	}
+	if gw.service.HashKey != "" {
+		kvs[serviceDefinition+HashKeyKey] = gw.service.HashKey
+	}
+	if gw.service.SlowStart > 0 {
+		kvs[serviceDefinition+SlowStartKey] = formatTimeout(gw.service.SlowStart)
+	}
+	if gw.service.MaxConns > 0 {
+		kvs[serviceDefinition+MaxConnsKey] = strconv.Itoa(gw.service.MaxConns)
+	}
+	if gw.service.MaxIdleConnDuration > 0 {
+		kvs[serviceDefinition+MaxIdleConnDurationKey] = formatTimeout(gw.service.MaxIdleConnDuration)
+	}
 	err = gw.putMany(kvs)
 	if err != nil {
 		logger.Error(err)
 		return err
 	}
+	var unset []string
+	if len(gw.service.AcceptHttpMethod) == 0 {
+		unset = append(unset, serviceDefinition+AcceptHttpMethodKey)
+	}
+	if gw.service.Timeout <= 0 {
+		unset = append(unset, serviceDefinition+TimeoutKey)
+	}
+	if gw.service.LoadBalancer == "" {
+		unset = append(unset, serviceDefinition+LoadBalancerKey)
+	}
+	if gw.service.HashKey == "" {
+		unset = append(unset, serviceDefinition+HashKeyKey)
+	}
+	if gw.service.SlowStart <= 0 {
+		unset = append(unset, serviceDefinition+SlowStartKey)
+	}
+	if gw.service.MaxConns <= 0 {
+		unset = append(unset, serviceDefinition+MaxConnsKey)
+	}
+	if gw.service.MaxIdleConnDuration <= 0 {
+		unset = append(unset, serviceDefinition+MaxIdleConnDurationKey)
+	}
+	if err = gw.deleteMany(unset); err != nil {
+		logger.Error(err)
+		return err
+	}
 	return nil
 }
 
@@ -524,13 +1152,9 @@ func (gw *ApiGatewayRegistrant) registerRouter() error {
 		} else {
 			frontend = r.Method + "@/" + r.Frontend
 		}
-		if resp.Count != 6 {
-			kvs[routerName+IDKey] = r.ID
-			kvs[routerName+NameKey] = r.Name
-			kvs[routerName+StatusKey] = strconv.FormatUint(uint64(r.Status), 10)
-			kvs[routerName+FrontendKey] = frontend
-			kvs[routerName+BackendKey] = r.Backend
-			kvs[routerName+ServiceKey] = r.Service.Name
+		attrs := r.attrs(routerName, frontend)
+		if resp.Count != int64(len(attrs)) {
+			kvs = attrs
 		} else {
 			for _, kv := range resp.Kvs {
 				if bytes.Equal(kv.Key, []byte(routerName+StatusKey)) {
@@ -560,6 +1184,11 @@ func (gw *ApiGatewayRegistrant) registerRouter() error {
 						kvs[routerName+ServiceKey] = r.Service.Name
 					}
 					ori[routerName+ServiceKey] = string(kv.Value)
+				} else if value, ok := attrs[string(kv.Key)]; ok {
+					if !bytes.Equal(kv.Value, []byte(value)) {
+						kvs[string(kv.Key)] = value
+					}
+					ori[string(kv.Key)] = string(kv.Value)
 				} else {
 					logger.Warnf("unrecognized router key: %s", string(kv.Key))
 				}
@@ -587,6 +1216,12 @@ func (gw *ApiGatewayRegistrant) registerRouter() error {
 			logger.Error(err)
 			return err
 		}
+		if unset := r.unsetAttrs(routerName); len(unset) > 0 {
+			if err = gw.deleteMany(unset); err != nil {
+				logger.Error(err)
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -653,6 +1288,20 @@ func (gw *ApiGatewayRegistrant) Register() error {
 	return nil
 }
 
+// SetWeight changes the weight of the registered node, e.g. to warm up a new node or to shift traffic away from it
+// without unregistering
+func (gw *ApiGatewayRegistrant) SetWeight(weight int) error {
+	gw.node.Weight = weight
+	nodeDefinition := fmt.Sprintf(NodeDefinition, gw.node.ID)
+	if err := gw.putMany(map[string]string{nodeDefinition + WeightKey: strconv.Itoa(weight)}); err != nil {
+		logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// Unregister marks the node as draining, the gateways stop sending it new requests at once. Call WaitDrained
+// before stopping the server to let the requests in flight complete.
 func (gw *ApiGatewayRegistrant) Unregister() error {
 	kvs := make(map[string]string)
 
@@ -663,7 +1312,7 @@ func (gw *ApiGatewayRegistrant) Unregister() error {
 		return err
 	}
 	if resp.Count != 0 {
-		kvs[nodeDefinition+StatusKey] = "2"
+		kvs[nodeDefinition+StatusKey] = strconv.Itoa(DrainingStatus)
 	}
 
 	err = gw.putMany(kvs)
@@ -673,3 +1322,41 @@ func (gw *ApiGatewayRegistrant) Unregister() error {
 	}
 	return nil
 }
+
+// WaitDrained blocks until every gateway reports no request in flight to the unregistered node, or until ctx is
+// done. The gateways are given DrainSettleTime to see the draining status first, it returns at once after that
+// when no gateway reported.
+func (gw *ApiGatewayRegistrant) WaitDrained(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(DrainSettleTime):
+	}
+
+	drainDefinition := fmt.Sprintf(DrainDefinition, gw.node.ID)
+	ticker := time.NewTicker(DrainPollInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := gw.getKeyValueWithPrefix(drainDefinition)
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+		idle := true
+		for _, kv := range resp.Kvs {
+			if string(kv.Value) != "0" {
+				logger.Debugf("gateway %s still has %s requests in flight", strings.TrimPrefix(string(kv.Key), drainDefinition), string(kv.Value))
+				idle = false
+			}
+		}
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}